@@ -0,0 +1,347 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ============================================
+// Redis Cluster Bus (multi-instance signaling)
+// ============================================
+//
+// Each instance keeps its own sockets and in-memory rooms. Redis holds the
+// shared roster and carries signals between instances:
+//
+//   sendit:room:{code}     hash   peerId -> instanceId, expiry refreshed by
+//                                 every instance with peers in the room
+//   sendit:instance:{id}   string heartbeat, expires if the instance dies
+//   sendit:inst:{id}       pubsub channel, one per instance
+//
+// A relay to a peer on another instance is published as a clusterEnvelope
+// to that instance's channel, which delivers the payload to its local peers.
+// Instances that stop heartbeating have their peers reaped from every room
+// roster and a peer-left is fanned out on their behalf.
+
+const (
+	clusterHeartbeatInterval = 5 * time.Second
+	clusterHeartbeatTTL      = 15 * time.Second
+	clusterReapInterval      = 10 * time.Second
+	clusterOpTimeout         = 2 * time.Second
+	// Publish reads rosters through a cache this old at most; joins and
+	// leaves announced by other instances invalidate it sooner.
+	clusterRosterCacheTTL = time.Second
+)
+
+// clusterEnvelope is the pub/sub wire format between instances.
+type clusterEnvelope struct {
+	Origin  string          `json:"origin"`            // publishing instance
+	Room    string          `json:"room"`              // room code
+	Exclude string          `json:"exclude,omitempty"` // peer that must not receive it (the sender)
+	Target  string          `json:"target,omitempty"`  // deliver only to this peer
+	Payload json.RawMessage `json:"payload"`           // message sent to peers verbatim
+}
+
+type clusterBus struct {
+	rdb        *redis.Client
+	instanceID string
+	rm         *RoomManager
+
+	rosterMu sync.Mutex
+	rosters  map[string]cachedRoster
+}
+
+type cachedRoster struct {
+	peers map[string]string
+	at    time.Time
+}
+
+func newClusterBus(rm *RoomManager) (*clusterBus, error) {
+	opts, err := redis.ParseURL(rm.cfg.RedisURL)
+	if err != nil {
+		return nil, err
+	}
+	rdb := redis.NewClient(opts)
+
+	ctx, cancel := context.WithTimeout(context.Background(), clusterOpTimeout)
+	defer cancel()
+	if err := rdb.Ping(ctx).Err(); err != nil {
+		return nil, err
+	}
+
+	b := make([]byte, 8)
+	rand.Read(b)
+	return &clusterBus{
+		rdb:        rdb,
+		instanceID: hex.EncodeToString(b),
+		rm:         rm,
+		rosters:    make(map[string]cachedRoster),
+	}, nil
+}
+
+func roomKey(code string) string       { return "sendit:room:" + code }
+func instanceKey(id string) string     { return "sendit:instance:" + id }
+func instanceChannel(id string) string { return "sendit:inst:" + id }
+
+func opContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), clusterOpTimeout)
+}
+
+// Run heartbeats, reaps dead instances and delivers inbound envelopes.
+// It blocks for the lifetime of the process.
+func (cb *clusterBus) Run() {
+	cb.heartbeat()
+	go func() {
+		ticker := time.NewTicker(clusterHeartbeatInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			cb.heartbeat()
+		}
+	}()
+	go func() {
+		ticker := time.NewTicker(clusterReapInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			cb.reap()
+		}
+	}()
+
+	sub := cb.rdb.Subscribe(context.Background(), instanceChannel(cb.instanceID))
+	defer sub.Close()
+	log.Printf("[Cluster] Instance %s subscribed", cb.instanceID)
+
+	for m := range sub.Channel() {
+		var env clusterEnvelope
+		if err := json.Unmarshal([]byte(m.Payload), &env); err != nil {
+			continue
+		}
+		var head struct {
+			Type string `json:"type"`
+		}
+		if json.Unmarshal(env.Payload, &head) == nil {
+			switch head.Type {
+			case "peer-joined", "peer-left", "room-closed":
+				cb.forgetRoster(env.Room)
+			}
+		}
+		cb.deliverLocal(env)
+	}
+}
+
+// heartbeat marks this instance alive and keeps the rosters of its rooms
+// from expiring. A roster only expires once no live instance has peers in
+// the room, however long ago the last join was.
+func (cb *clusterBus) heartbeat() {
+	ctx, cancel := opContext()
+	defer cancel()
+	pipe := cb.rdb.Pipeline()
+	pipe.Set(ctx, instanceKey(cb.instanceID), time.Now().Unix(), clusterHeartbeatTTL)
+	cb.rm.rooms.Range(func(key, value interface{}) bool {
+		if value.(*Room).PeerCount() > 0 {
+			pipe.Expire(ctx, roomKey(key.(string)), clusterHeartbeatTTL)
+		}
+		return true
+	})
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Printf("[Cluster] Heartbeat failed: %v", err)
+	}
+
+	cb.rosterMu.Lock()
+	for code, c := range cb.rosters {
+		if time.Since(c.at) >= clusterRosterCacheTTL {
+			delete(cb.rosters, code)
+		}
+	}
+	cb.rosterMu.Unlock()
+}
+
+// deliverLocal sends env.Payload to this instance's peers in env.Room.
+func (cb *clusterBus) deliverLocal(env clusterEnvelope) {
+	val, ok := cb.rm.rooms.Load(env.Room)
+	if !ok {
+		return
+	}
+	room := val.(*Room)
+	room.Peers.Range(func(key, value interface{}) bool {
+		pid := key.(string)
+		if pid == env.Exclude || (env.Target != "" && pid != env.Target) {
+			return true
+		}
+		value.(*Peer).SendJSON(env.Payload)
+		return true
+	})
+}
+
+// Join records peerID as living on this instance.
+func (cb *clusterBus) Join(code, peerID string) {
+	ctx, cancel := opContext()
+	defer cancel()
+	pipe := cb.rdb.TxPipeline()
+	pipe.HSet(ctx, roomKey(code), peerID, cb.instanceID)
+	pipe.Expire(ctx, roomKey(code), clusterHeartbeatTTL)
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Printf("[Cluster] Join %s/%s failed: %v", code, peerID, err)
+	}
+	cb.forgetRoster(code)
+}
+
+// leaveScript removes a peer and deletes the roster once it is empty, in
+// one step, so a peer joining on another instance in between isn't lost.
+var leaveScript = redis.NewScript(`
+redis.call("HDEL", KEYS[1], ARGV[1])
+if redis.call("HLEN", KEYS[1]) == 0 then
+	redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// Leave drops peerID from the shared roster, deleting the room when empty.
+func (cb *clusterBus) Leave(code, peerID string) {
+	ctx, cancel := opContext()
+	defer cancel()
+	if err := leaveScript.Run(ctx, cb.rdb, []string{roomKey(code)}, peerID).Err(); err != nil {
+		log.Printf("[Cluster] Leave %s/%s failed: %v", code, peerID, err)
+	}
+	cb.forgetRoster(code)
+}
+
+// Exists reports whether any instance has peers in the room.
+func (cb *clusterBus) Exists(code string) bool {
+	ctx, cancel := opContext()
+	defer cancel()
+	n, err := cb.rdb.Exists(ctx, roomKey(code)).Result()
+	return err == nil && n > 0
+}
+
+// Roster returns peerId -> instanceId for the whole room, read fresh.
+func (cb *clusterBus) Roster(code string) map[string]string {
+	ctx, cancel := opContext()
+	defer cancel()
+	roster, err := cb.rdb.HGetAll(ctx, roomKey(code)).Result()
+	if err != nil {
+		return nil
+	}
+	cb.rosterMu.Lock()
+	cb.rosters[code] = cachedRoster{peers: roster, at: time.Now()}
+	cb.rosterMu.Unlock()
+	return roster
+}
+
+// cachedRosterFor is Roster for the relay path, which would otherwise hit
+// Redis once per relayed message and target.
+func (cb *clusterBus) cachedRosterFor(code string) map[string]string {
+	cb.rosterMu.Lock()
+	c, ok := cb.rosters[code]
+	cb.rosterMu.Unlock()
+	if ok && time.Since(c.at) < clusterRosterCacheTTL {
+		return c.peers
+	}
+	return cb.Roster(code)
+}
+
+func (cb *clusterBus) forgetRoster(code string) {
+	cb.rosterMu.Lock()
+	delete(cb.rosters, code)
+	cb.rosterMu.Unlock()
+}
+
+// Publish forwards payload to every other instance with peers in the room,
+// or only to the instance hosting target when one is given. It reports
+// whether the payload reached Redis for at least one remote instance.
+func (cb *clusterBus) Publish(code, exclude, target string, payload interface{}) bool {
+	roster := cb.cachedRosterFor(code)
+
+	instances := make(map[string]bool)
+	if target != "" {
+		if inst, ok := roster[target]; ok && inst != cb.instanceID {
+			instances[inst] = true
+		}
+	} else {
+		for _, inst := range roster {
+			if inst != cb.instanceID {
+				instances[inst] = true
+			}
+		}
+	}
+	if len(instances) == 0 {
+		return false
+	}
+
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		return false
+	}
+	data, _ := json.Marshal(clusterEnvelope{
+		Origin:  cb.instanceID,
+		Room:    code,
+		Exclude: exclude,
+		Target:  target,
+		Payload: raw,
+	})
+
+	ctx, cancel := opContext()
+	defer cancel()
+	sent := false
+	for inst := range instances {
+		if err := cb.rdb.Publish(ctx, instanceChannel(inst), data).Err(); err != nil {
+			log.Printf("[Cluster] Publish to %s for %s failed: %v", inst, code, err)
+			continue
+		}
+		sent = true
+	}
+	return sent
+}
+
+// reap removes peers owned by instances whose heartbeat has expired and
+// announces their departure to the survivors.
+func (cb *clusterBus) reap() {
+	ctx, cancel := context.WithTimeout(context.Background(), clusterReapInterval)
+	defer cancel()
+
+	alive := map[string]bool{cb.instanceID: true}
+	iter := cb.rdb.Scan(ctx, 0, roomKey("*"), 500).Iterator()
+	for iter.Next(ctx) {
+		key := iter.Val()
+		code := key[len(roomKey("")):]
+		roster, err := cb.rdb.HGetAll(ctx, key).Result()
+		if err != nil {
+			continue
+		}
+		remaining := len(roster)
+		for peerID, inst := range roster {
+			live, seen := alive[inst]
+			if !seen {
+				n, err := cb.rdb.Exists(ctx, instanceKey(inst)).Result()
+				if err != nil {
+					continue
+				}
+				live = n > 0
+				alive[inst] = live
+			}
+			if live {
+				continue
+			}
+			// Only the instance whose HDEL wins announces the departure
+			if removed, _ := cb.rdb.HDel(ctx, key, peerID).Result(); removed == 0 {
+				continue
+			}
+			remaining--
+			cb.forgetRoster(code)
+			left := map[string]interface{}{
+				"type":      "peer-left",
+				"peerId":    peerID,
+				"peerCount": remaining,
+			}
+			raw, _ := json.Marshal(left)
+			cb.deliverLocal(clusterEnvelope{Room: code, Payload: raw})
+			cb.Publish(code, "", "", left)
+			log.Printf("[Cluster] Reaped peer %s in %s from dead instance %s", peerID, code, inst)
+		}
+	}
+}
@@ -3,8 +3,12 @@ module sendit-server
 go 1.22
 
 require (
+	github.com/cespare/xxhash/v2 v2.3.0
 	github.com/gorilla/websocket v1.5.3
 	github.com/pierrec/lz4/v4 v4.1.21
-	github.com/cespare/xxhash/v2 v2.3.0
+	github.com/redis/go-redis/v9 v9.5.1
 	github.com/rs/cors v1.11.1
+	github.com/skip2/go-qrcode v0.0.0-20200617195104-da1b6568686e
 )
+
+require github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
@@ -15,18 +15,35 @@ Features:
 package main
 
 import (
+	"archive/zip"
+	"bufio"
+	"bytes"
 	"compress/gzip"
+	"container/list"
+	"context"
+	"crypto/ed25519"
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"math/big"
+	"mime/multipart"
+	"net"
 	"net/http"
+	"net/http/pprof"
 	"os"
 	"os/signal"
-	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -37,6 +54,17 @@ import (
 	"github.com/gorilla/websocket"
 	"github.com/pierrec/lz4/v4"
 	"github.com/rs/cors"
+	"github.com/skip2/go-qrcode"
+)
+
+// ============================================
+// Build Info (set via -ldflags "-X main.version=...")
+// ============================================
+
+var (
+	version   = "2.0.0"
+	gitCommit = "unknown"
+	buildTime = "unknown"
 )
 
 // ============================================
@@ -44,18 +72,103 @@ import (
 // ============================================
 
 type Config struct {
-	Host             string
-	Port             int
-	MaxRooms         int
-	MaxPeersPerRoom  int
-	RoomTimeout      time.Duration
-	RoomCodeLength   int
-	UploadDir        string
-	MaxFileSize      int64
-	ChunkSize        int
-	RelayFileTTL     time.Duration
-	MaxMsgPerSecond  int
-	MaxConnsPerIP    int
+	Host            string
+	Port            int
+	MaxRooms        int
+	MaxPeersPerRoom int
+	RoomTimeout     time.Duration
+	RoomCodeLength  int
+	UploadDir       string
+	MaxFileSize     int64
+	ChunkSize       int
+	RelayFileTTL    time.Duration
+	MaxMsgPerSecond int
+	MaxConnsPerIP   int
+	MaxRoomsPerIP   int
+	MsgDedupWindow  time.Duration // 0 disables msgId dedup
+	PingInterval    time.Duration
+	MaxMissedPongs  int               // consecutive unanswered pings before ping-timeout
+	PublicURL       string            // e.g. https://send.example.com, used for absolute links
+	RoomIdleTimeout time.Duration     // close rooms with no relayed traffic, 0 = off
+	MaxFiles        int               // soft cap on stored relay files, 0 = unlimited
+	EvictOnFull     bool              // at MaxFiles, evict soonest-to-expire instead of rejecting
+	DownloadHeaders map[string]string // extra response headers on relay downloads
+	// MIME types stored without LZ4 unless ?compress=true; "video/" matches a prefix
+	IncompressibleTypes []string
+	GzipLevel           int // API response gzip level, -2 (Huffman only) to 9
+	GzipMinSize         int // responses smaller than this are sent uncompressed
+	// Content types worth gzipping; "text/" matches a prefix
+	GzipTypes           []string
+	MaxOfferFiles       int    // files allowed in one transfer-offer
+	MOTD                string // notice sent to each peer after room-joined
+	LogPayloads         bool   // log signaling message bodies (debug only)
+	MaxDownloadRate     int64  // bytes/sec, 0 = unlimited
+	RangeCacheMax       int64  // largest compressed file decompressed for Range requests, 0 = off
+	MaxPeers            int    // server-wide peer cap, 0 = unlimited
+	AdmissionQueue      int    // joiners allowed to wait for a slot at MaxPeers
+	StorageBackend      string // "local" or "s3"
+	Mirror              string // secondary backend every upload is copied to: "", "local" or "s3"
+	MirrorDir           string // directory for a "local" mirror, e.g. an NFS mount
+	MirrorAsync         bool   // copy after the upload completes instead of teeing it
+	MirrorRequired      bool   // fail uploads the mirror could not take (sync mode only)
+	S3Endpoint          string
+	S3Bucket            string
+	S3Region            string
+	S3Prefix            string
+	S3AccessKey         string
+	S3SecretKey         string
+	RedisURL            string            // enables multi-instance signaling when set
+	LimitStore          string            // "memory" or "redis" (shares limits across instances)
+	AuditLog            string            // download audit destination: "", "stdout", "stderr" or a file path
+	DownloadSecret      []byte            // when set, downloads need a valid ?exp=&sig=
+	DownloadURLTTL      time.Duration     // lifetime of signed download URLs
+	AdminToken          string            // bearer token for /api/admin/*, empty disables it
+	DrainTimeout        time.Duration     // on SIGTERM, wait this long for peers to leave
+	KeepExtensions      bool              // store relay files as {id}{ext} instead of {id}
+	StreamWindow        int               // unacked stream-chunks allowed in flight per stream
+	StreamChunkMax      int               // max stream-chunk data length
+	ServerName          string            // reported in health, version and notices
+	BatchWindow         time.Duration     // send coalescing window for peers that opt in, 0 = off
+	RoomMsgPerSecond    int               // relayed messages per room per second, 0 = unlimited
+	RoomBytesPerSecond  int64             // relayed bytes per room per second, 0 = unlimited
+	UploadSlowStart     time.Duration     // upload rate ramp length, 0 = off
+	UploadSlowStartRate int64             // upload rate (bytes/sec) at the start of the ramp
+	JoinHMACKey         []byte            // when set, joins need an HMAC-SHA256 ?sig=
+	JoinEd25519Key      ed25519.PublicKey // when set, joins need an Ed25519 ?sig=
+	JoinSigMaxAge       time.Duration     // accepted clock skew/age of a join ?ts=
+	GuestCreatesRoom    bool              // guests joining a missing room create it instead of ROOM_NOT_FOUND
+	StampMessages       bool              // add per-room "serverSeq" and "serverTs" to relayed messages
+	SupportURL          string            // optional operator contact, shown alongside ServerName
+	BreakerThreshold    int               // consecutive storage write failures that open the breaker, 0 = off
+	BreakerCooldown     time.Duration     // how long an open breaker fast-fails uploads
+	ReadHeaderTimeout   time.Duration     // time allowed to send request headers
+	IdleTimeout         time.Duration     // how long an idle keep-alive connection stays open
+	ReconnectLimit      int               // joins per peer_id allowed within ReconnectWindow, 0 = unlimited
+	ReconnectWindow     time.Duration
+	MaxMessageSize      int64         // WebSocket read limit, and the cap on per-room overrides
+	Pprof               bool          // serve net/http/pprof under /api/admin/debug/pprof/
+	WSCompression       bool          // offer permessage-deflate on WebSocket connections
+	UploadGrace         time.Duration // on SIGTERM, wait this long for in-flight uploads
+	RoomTombstone       time.Duration // closed room codes are not reused for this long, 0 = off
+	MaxDownloadsPerFile int           // concurrent downloads of one file, 0 = unlimited
+	RelayKeepsRoom      bool          // relay uploads/downloads count as activity in their room
+	DownloadStall       time.Duration // drop a download whose client stops reading this long, 0 = never
+	DownloadMaxDuration time.Duration // hard cap on one download response, 0 = none
+	APIWriteTimeout     time.Duration // write deadline for non-streaming API responses, 0 = none
+	ReservedCodes       []string      // room codes that are never generated, created or joined
+	CodeFilter          bool          // skip generated codes containing codeFilterWords
+	PingMin             time.Duration // adaptive ping interval floor, for flaky links
+	PingMax             time.Duration // adaptive ping interval ceiling, for stable links
+	WSMaxHeaderBytes    int           // request line plus headers allowed on /ws/ upgrades
+	WSMaxQueryLen       int           // query string bytes allowed on /ws/ upgrades
+	StorageRetries      int           // retries of a local storage op failing with a transient error
+	StorageRetryBackoff time.Duration // first retry delay, doubled for each further retry
+	AbsentTarget        string        // default for messages to a missing targetId: drop, error or queue
+	AbsentTargetHold    time.Duration // how long the queue policy holds a message for its target
+	// Per-peer messages per second by "type", on top of MaxMsgPerSecond
+	MsgTypeLimits map[string]int
+	RequireHello  bool          // peers must send {"type":"hello","version":...} before joining
+	HelloTimeout  time.Duration // how long a new connection has to send hello
 }
 
 func NewConfig() *Config {
@@ -83,32 +196,461 @@ func NewConfig() *Config {
 		RoomCodeLength:  6,
 		UploadDir:       uploadDir,
 		MaxFileSize:     5 * 1024 * 1024 * 1024, // 5GB
-		ChunkSize:       1024 * 1024,              // 1MB
+		ChunkSize:       1024 * 1024,            // 1MB
 		RelayFileTTL:    1 * time.Hour,
 		MaxMsgPerSecond: 200,
 		MaxConnsPerIP:   20,
+		MaxRoomsPerIP:   int(envInt64("SENDIT_GO_MAX_ROOMS_PER_IP", 100)),
+		MsgDedupWindow:  envDuration("SENDIT_GO_DEDUP_WINDOW", 30*time.Second),
+		PingInterval:    envDuration("SENDIT_GO_PING_INTERVAL", 25*time.Second),
+		MaxMissedPongs:  int(envInt64("SENDIT_GO_MAX_MISSED_PONGS", 2)),
+		PublicURL:       strings.TrimRight(envString("SENDIT_PUBLIC_URL", ""), "/"),
+		RoomIdleTimeout: envDuration("SENDIT_GO_ROOM_IDLE_TIMEOUT", 0),
+		MaxFiles:        int(envInt64("SENDIT_GO_MAX_FILES", 10000)),
+		EvictOnFull:     envBool("SENDIT_GO_EVICT_ON_FULL", false),
+		DownloadHeaders: envHeaders("SENDIT_GO_DOWNLOAD_HEADERS"),
+		IncompressibleTypes: envList("SENDIT_GO_INCOMPRESSIBLE_TYPES", []string{
+			"image/jpeg", "image/png", "image/gif", "image/webp",
+			"video/", "audio/mpeg", "audio/ogg", "audio/aac",
+			"application/zip", "application/x-gzip", "application/x-rar-compressed",
+			"application/x-7z-compressed", "application/pdf",
+			"font/woff", "font/woff2",
+		}),
+		GzipLevel:           envGzipLevel("SENDIT_GZIP_LEVEL"),
+		GzipMinSize:         int(envInt64("SENDIT_GO_GZIP_MIN_SIZE", 1024)),
+		GzipTypes:           envList("SENDIT_GO_GZIP_TYPES", []string{"application/json", "text/"}),
+		MaxOfferFiles:       int(envInt64("SENDIT_GO_MAX_OFFER_FILES", 100)),
+		MOTD:                envString("SENDIT_MOTD", ""),
+		LogPayloads:         envBool("SENDIT_LOG_PAYLOADS", false),
+		MaxDownloadRate:     envInt64("SENDIT_GO_MAX_DOWNLOAD_RATE", 0),
+		RangeCacheMax:       envInt64("SENDIT_GO_RANGE_CACHE_MAX", 0),
+		MaxPeers:            int(envInt64("SENDIT_GO_MAX_PEERS", 0)),
+		AdmissionQueue:      int(envInt64("SENDIT_GO_ADMISSION_QUEUE", 1000)),
+		StorageBackend:      envString("SENDIT_GO_STORAGE", "local"),
+		Mirror:              envString("SENDIT_GO_MIRROR", ""),
+		MirrorDir:           envString("SENDIT_GO_MIRROR_DIR", ""),
+		MirrorAsync:         envBool("SENDIT_GO_MIRROR_ASYNC", false),
+		MirrorRequired:      envString("SENDIT_GO_MIRROR_POLICY", "best-effort") == "required",
+		S3Endpoint:          envString("SENDIT_GO_S3_ENDPOINT", ""),
+		S3Bucket:            envString("SENDIT_GO_S3_BUCKET", ""),
+		S3Region:            envString("SENDIT_GO_S3_REGION", "us-east-1"),
+		S3Prefix:            envString("SENDIT_GO_S3_PREFIX", ""),
+		S3AccessKey:         envString("SENDIT_GO_S3_ACCESS_KEY", ""),
+		S3SecretKey:         envString("SENDIT_GO_S3_SECRET_KEY", ""),
+		RedisURL:            envString("SENDIT_GO_REDIS_URL", ""),
+		LimitStore:          envString("SENDIT_GO_LIMIT_STORE", "memory"),
+		AuditLog:            envString("SENDIT_GO_AUDIT_LOG", ""),
+		DownloadSecret:      []byte(envString("SENDIT_GO_DOWNLOAD_SECRET", "")),
+		DownloadURLTTL:      envDuration("SENDIT_GO_DOWNLOAD_URL_TTL", time.Hour),
+		AdminToken:          envString("SENDIT_GO_ADMIN_TOKEN", ""),
+		DrainTimeout:        envDuration("SENDIT_GO_DRAIN_TIMEOUT", 0),
+		KeepExtensions:      envBool("SENDIT_GO_KEEP_EXTENSIONS", false),
+		StreamWindow:        int(envInt64("SENDIT_GO_STREAM_WINDOW", 16)),
+		StreamChunkMax:      int(envInt64("SENDIT_GO_STREAM_CHUNK_MAX", 64*1024)),
+		ServerName:          envString("SENDIT_GO_SERVER_NAME", "SendIt-Go"),
+		BatchWindow:         envDuration("SENDIT_GO_BATCH_WINDOW", 2*time.Millisecond),
+		RoomMsgPerSecond:    int(envInt64("SENDIT_GO_ROOM_MSG_RATE", 1000)),
+		RoomBytesPerSecond:  envInt64("SENDIT_GO_ROOM_BYTE_RATE", 32*1024*1024),
+		UploadSlowStart:     envDuration("SENDIT_UPLOAD_SLOWSTART", 0),
+		UploadSlowStartRate: envInt64("SENDIT_GO_UPLOAD_SLOWSTART_RATE", 512*1024),
+		JoinHMACKey:         []byte(envString("SENDIT_GO_JOIN_HMAC_KEY", "")),
+		JoinEd25519Key:      envEd25519Key("SENDIT_GO_JOIN_ED25519_KEY"),
+		JoinSigMaxAge:       envDuration("SENDIT_GO_JOIN_SIG_MAX_AGE", 5*time.Minute),
+		GuestCreatesRoom:    envString("SENDIT_GO_GUEST_JOIN", "reject") == "create",
+		StampMessages:       envBool("SENDIT_GO_STAMP_MESSAGES", false),
+		SupportURL:          envString("SENDIT_GO_SUPPORT_URL", ""),
+		BreakerThreshold:    int(envInt64("SENDIT_GO_BREAKER_THRESHOLD", 5)),
+		BreakerCooldown:     envDuration("SENDIT_GO_BREAKER_COOLDOWN", 30*time.Second),
+		ReadHeaderTimeout:   envDuration("SENDIT_GO_READ_HEADER_TIMEOUT", 10*time.Second),
+		IdleTimeout:         envDuration("SENDIT_GO_IDLE_TIMEOUT", 120*time.Second),
+		ReconnectLimit:      int(envInt64("SENDIT_GO_RECONNECT_LIMIT", 10)),
+		ReconnectWindow:     envDuration("SENDIT_GO_RECONNECT_WINDOW", 30*time.Second),
+		MaxMessageSize:      envInt64("SENDIT_GO_MAX_MESSAGE_SIZE", 16*1024*1024),
+		Pprof:               envBool("SENDIT_GO_PPROF", false),
+		WSCompression:       envBool("SENDIT_GO_WS_COMPRESSION", false),
+		UploadGrace:         envDuration("SENDIT_GO_UPLOAD_GRACE", 30*time.Second),
+		RoomTombstone:       envDuration("SENDIT_GO_ROOM_TOMBSTONE", 0),
+		MaxDownloadsPerFile: int(envInt64("SENDIT_GO_MAX_DOWNLOADS_PER_FILE", 0)),
+		RelayKeepsRoom:      envBool("SENDIT_GO_RELAY_KEEPS_ROOM", true),
+		DownloadStall:       envDuration("SENDIT_GO_DOWNLOAD_STALL_TIMEOUT", 2*time.Minute),
+		DownloadMaxDuration: envDuration("SENDIT_GO_DOWNLOAD_MAX_DURATION", 0),
+		APIWriteTimeout:     envDuration("SENDIT_GO_API_WRITE_TIMEOUT", 30*time.Second),
+		ReservedCodes:       envList("SENDIT_GO_RESERVED_CODES", nil),
+		CodeFilter:          envBool("SENDIT_GO_CODE_FILTER", false),
+		PingMin:             envDuration("SENDIT_GO_PING_INTERVAL_MIN", 10*time.Second),
+		PingMax:             envDuration("SENDIT_GO_PING_INTERVAL_MAX", 60*time.Second),
+		WSMaxHeaderBytes:    int(envInt64("SENDIT_GO_WS_MAX_HEADER_BYTES", 8*1024)),
+		WSMaxQueryLen:       int(envInt64("SENDIT_GO_WS_MAX_QUERY_LENGTH", 2048)),
+		StorageRetries:      int(envInt64("SENDIT_GO_STORAGE_RETRIES", 3)),
+		StorageRetryBackoff: envDuration("SENDIT_GO_STORAGE_RETRY_BACKOFF", 50*time.Millisecond),
+		AbsentTarget:        envString("SENDIT_GO_ABSENT_TARGET_POLICY", absentDrop),
+		AbsentTargetHold:    envDuration("SENDIT_GO_ABSENT_TARGET_HOLD", 10*time.Second),
+		MsgTypeLimits: envIntMap("SENDIT_GO_MSG_TYPE_LIMITS", map[string]int{
+			"offer": 5, "answer": 5, "ice-candidate": 100,
+		}),
+		RequireHello: envBool("SENDIT_GO_REQUIRE_HELLO", false),
+		HelloTimeout: envDuration("SENDIT_GO_HELLO_TIMEOUT", 5*time.Second),
+	}
+}
+
+const maxRoomCodeLength = 16
+
+// Validate checks that limits are usable and that the upload dir and
+// listen address work, so a misconfiguration fails at startup with every
+// problem listed rather than surfacing later at runtime.
+func (c *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	check(c.Port > 0 && c.Port <= 65535, "port %d out of range (SENDIT_GO_PORT)", c.Port)
+	check(c.MaxPeersPerRoom >= 1, "MaxPeersPerRoom must be at least 1, got %d", c.MaxPeersPerRoom)
+	check(c.MaxRooms >= 1, "MaxRooms must be at least 1, got %d", c.MaxRooms)
+	check(c.ChunkSize > 0, "ChunkSize must be positive, got %d", c.ChunkSize)
+	check(c.MaxFileSize > 0, "MaxFileSize must be positive, got %d", c.MaxFileSize)
+	check(c.RelayFileTTL > 0, "RelayFileTTL must be positive, got %s", c.RelayFileTTL)
+	check(c.RoomTimeout > 0, "RoomTimeout must be positive, got %s", c.RoomTimeout)
+	check(c.PingInterval > 0, "SENDIT_GO_PING_INTERVAL must be positive, got %s", c.PingInterval)
+	check(c.WSMaxHeaderBytes >= 1024, "SENDIT_GO_WS_MAX_HEADER_BYTES must be at least 1024, got %d", c.WSMaxHeaderBytes)
+	check(c.WSMaxQueryLen >= 256, "SENDIT_GO_WS_MAX_QUERY_LENGTH must be at least 256, got %d", c.WSMaxQueryLen)
+	check(validAbsentPolicy(c.AbsentTarget), "SENDIT_GO_ABSENT_TARGET_POLICY must be drop, error or queue, got %q", c.AbsentTarget)
+	check(c.AbsentTargetHold > 0, "SENDIT_GO_ABSENT_TARGET_HOLD must be positive, got %s", c.AbsentTargetHold)
+	check(c.HelloTimeout > 0, "SENDIT_GO_HELLO_TIMEOUT must be positive, got %s", c.HelloTimeout)
+	for msgType, limit := range c.MsgTypeLimits {
+		check(limit > 0, "SENDIT_GO_MSG_TYPE_LIMITS: limit for %q must be positive, got %d", msgType, limit)
+	}
+	check(c.StorageRetries >= 0, "SENDIT_GO_STORAGE_RETRIES must not be negative, got %d", c.StorageRetries)
+	check(c.PingMin > 0, "SENDIT_GO_PING_INTERVAL_MIN must be positive, got %s", c.PingMin)
+	check(c.PingMax >= c.PingMin, "SENDIT_GO_PING_INTERVAL_MAX (%s) must be at least SENDIT_GO_PING_INTERVAL_MIN (%s)", c.PingMax, c.PingMin)
+	check(c.MaxConnsPerIP >= 1, "MaxConnsPerIP must be at least 1, got %d", c.MaxConnsPerIP)
+	check(c.MaxOfferFiles >= 1, "SENDIT_GO_MAX_OFFER_FILES must be at least 1, got %d", c.MaxOfferFiles)
+	check(c.StreamWindow >= 1, "SENDIT_GO_STREAM_WINDOW must be at least 1, got %d", c.StreamWindow)
+	check(c.StreamChunkMax >= 1, "SENDIT_GO_STREAM_CHUNK_MAX must be at least 1, got %d", c.StreamChunkMax)
+	check(c.ReadHeaderTimeout > 0, "SENDIT_GO_READ_HEADER_TIMEOUT must be positive, got %s", c.ReadHeaderTimeout)
+	check(c.IdleTimeout > 0, "SENDIT_GO_IDLE_TIMEOUT must be positive, got %s", c.IdleTimeout)
+	check(c.MaxMessageSize >= 1, "SENDIT_GO_MAX_MESSAGE_SIZE must be at least 1, got %d", c.MaxMessageSize)
+	check(c.ReconnectLimit <= 0 || c.ReconnectWindow > 0,
+		"SENDIT_GO_RECONNECT_WINDOW must be positive, got %s", c.ReconnectWindow)
+
+	// Keep the code space well above MaxRooms, or GenerateRoomCode keeps
+	// colliding with live rooms
+	if c.RoomCodeLength < 1 || c.RoomCodeLength > maxRoomCodeLength {
+		check(false, "RoomCodeLength must be 1-%d, got %d", maxRoomCodeLength, c.RoomCodeLength)
+	} else {
+		space := math.Pow(float64(len(roomCodeChars)), float64(c.RoomCodeLength))
+		check(space >= 100*float64(c.MaxRooms),
+			"RoomCodeLength %d gives %.0f codes, too few for MaxRooms %d", c.RoomCodeLength, space, c.MaxRooms)
+	}
+
+	if c.StorageBackend == "" || c.StorageBackend == "local" {
+		if err := probeDir(c.UploadDir); err != nil {
+			check(false, "upload dir %s is not writable (SENDIT_GO_UPLOAD_DIR): %v", c.UploadDir, err)
+		}
+	}
+	if c.Mirror == "local" {
+		if c.MirrorDir == "" || c.MirrorDir == c.UploadDir {
+			check(false, "SENDIT_GO_MIRROR_DIR must be set to a directory other than the upload dir")
+		} else if err := probeDir(c.MirrorDir); err != nil {
+			check(false, "mirror dir %s is not writable (SENDIT_GO_MIRROR_DIR): %v", c.MirrorDir, err)
+		}
+	}
+	check(c.Mirror != "s3" || c.StorageBackend != "s3", "SENDIT_GO_MIRROR=s3 needs a local primary storage")
+
+	addr := fmt.Sprintf("%s:%d", c.Host, c.Port)
+	if ln, err := net.Listen("tcp", addr); err != nil {
+		check(false, "cannot bind %s (SENDIT_GO_HOST/SENDIT_GO_PORT): %v", addr, err)
+	} else {
+		ln.Close()
+	}
+
+	return errors.Join(errs...)
+}
+
+// probeDir creates dir if needed, then writes and removes a probe file.
+func probeDir(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, ".probe-*")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write([]byte("ok"))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if rerr := os.Remove(f.Name()); err == nil {
+		err = rerr
+	}
+	return err
+}
+
+func envDuration(key string, def time.Duration) time.Duration {
+	if v := os.Getenv(key); v != "" {
+		if d, err := time.ParseDuration(v); err == nil {
+			return d
+		}
+	}
+	return def
+}
+
+func envBool(key string, def bool) bool {
+	if v := os.Getenv(key); v != "" {
+		if b, err := strconv.ParseBool(v); err == nil {
+			return b
+		}
+	}
+	return def
+}
+
+// protectedHeaders are computed per response and can't be overridden by
+// SENDIT_GO_DOWNLOAD_HEADERS without breaking range and conditional requests.
+var protectedHeaders = map[string]bool{
+	"Content-Length":      true,
+	"Content-Range":       true,
+	"Content-Encoding":    true,
+	"Content-Disposition": true,
+	"Accept-Ranges":       true,
+	"Etag":                true,
+	"Last-Modified":       true,
+}
+
+// envHeaders parses a JSON object of header names to values, e.g.
+// {"Cache-Control":"public, max-age=3600, immutable"}.
+func envHeaders(key string) map[string]string {
+	v := os.Getenv(key)
+	if v == "" {
+		return nil
+	}
+	var raw map[string]string
+	if err := json.Unmarshal([]byte(v), &raw); err != nil {
+		log.Printf("[Config] Ignoring %s: %v", key, err)
+		return nil
+	}
+	headers := make(map[string]string, len(raw))
+	for name, value := range raw {
+		name = http.CanonicalHeaderKey(name)
+		if protectedHeaders[name] {
+			log.Printf("[Config] Ignoring protected header %s in %s", name, key)
+			continue
+		}
+		headers[name] = value
+	}
+	return headers
+}
+
+// envIntMap reads a JSON object of integers, e.g. {"offer":5}. Unset
+// returns def; "{}" clears it.
+func envIntMap(key string, def map[string]int) map[string]int {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	var m map[string]int
+	if err := json.Unmarshal([]byte(v), &m); err != nil {
+		log.Printf("[Config] Ignoring %s: %v", key, err)
+		return def
+	}
+	return m
+}
+
+// envEd25519Key reads a base64 Ed25519 public key. A malformed key is
+// fatal: silently dropping it would disable join verification.
+func envEd25519Key(key string) ed25519.PublicKey {
+	v := os.Getenv(key)
+	if v == "" {
+		return nil
+	}
+	raw, err := base64.StdEncoding.DecodeString(v)
+	if err != nil || len(raw) != ed25519.PublicKeySize {
+		log.Fatalf("[Config] %s must be a base64 %d-byte Ed25519 public key", key, ed25519.PublicKeySize)
+	}
+	return ed25519.PublicKey(raw)
+}
+
+func envGzipLevel(key string) int {
+	level := int(envInt64(key, gzip.DefaultCompression))
+	if level < gzip.HuffmanOnly || level > gzip.BestCompression {
+		log.Printf("[Config] %s=%d out of range [%d, %d], using default", key, level, gzip.HuffmanOnly, gzip.BestCompression)
+		return gzip.DefaultCompression
+	}
+	return level
+}
+
+// envList parses a comma-separated list, ignoring blank entries.
+func envList(key string, def []string) []string {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	var list []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+func envString(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
 	}
+	return def
 }
 
-var cfg = NewConfig()
+func envInt64(key string, def int64) int64 {
+	if v := os.Getenv(key); v != "" {
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+			return n
+		}
+	}
+	return def
+}
 
 // ============================================
 // Buffer Pool for zero-alloc I/O
 // ============================================
 
-var bufferPool = sync.Pool{
-	New: func() interface{} {
-		buf := make([]byte, cfg.ChunkSize)
+type bufferPool struct {
+	pool   sync.Pool
+	gets   atomic.Int64
+	allocs atomic.Int64 // gets the pool could not serve from a returned buffer
+}
+
+func newBufferPool(size int) *bufferPool {
+	bp := &bufferPool{}
+	bp.pool.New = func() interface{} {
+		bp.allocs.Add(1)
+		buf := make([]byte, size)
 		return &buf
-	},
+	}
+	return bp
+}
+
+func (bp *bufferPool) get() *[]byte {
+	bp.gets.Add(1)
+	return bp.pool.Get().(*[]byte)
+}
+
+func (bp *bufferPool) put(buf *[]byte) {
+	bp.pool.Put(buf)
+}
+
+// ============================================
+// Rate-Limited Reader (token bucket)
+// ============================================
+
+const minDownloadRate = 1024 // 1KB/s floor so reads always make progress
+
+// rateLimitedReader throttles reads from r to rate bytes/sec.
+// Waits are abandoned as soon as ctx is cancelled, so a client that
+// disconnects mid-download never leaves the copy loop sleeping.
+type rateLimitedReader struct {
+	r      io.Reader
+	ctx    context.Context
+	rate   int64
+	tokens int64
+	last   time.Time
+}
+
+func newRateLimitedReader(ctx context.Context, r io.Reader, rate int64) *rateLimitedReader {
+	if rate < minDownloadRate {
+		rate = minDownloadRate
+	}
+	return &rateLimitedReader{r: r, ctx: ctx, rate: rate, tokens: rate, last: time.Now()}
+}
+
+func (l *rateLimitedReader) Read(p []byte) (int, error) {
+	// Never ask for more than one second's worth of tokens
+	if int64(len(p)) > l.rate {
+		p = p[:l.rate]
+	}
+
+	now := time.Now()
+	l.tokens += int64(now.Sub(l.last).Seconds() * float64(l.rate))
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+
+	if need := int64(len(p)) - l.tokens; need > 0 {
+		wait := time.Duration(float64(need) / float64(l.rate) * float64(time.Second))
+		timer := time.NewTimer(wait)
+		select {
+		case <-l.ctx.Done():
+			timer.Stop()
+			return 0, l.ctx.Err()
+		case <-timer.C:
+		}
+		l.tokens += need
+		l.last = time.Now()
+	}
+
+	n, err := l.r.Read(p)
+	l.tokens -= int64(n)
+	return n, err
+}
+
+// slowStartBody ramps an upload body's read rate: it starts at the
+// configured initial rate and grows exponentially over the ramp, by
+// slowStartDoublings doublings in all, after which reads are unthrottled.
+// Many uploads starting at once then reach the disk gradually instead of
+// as one spike, however long the ramp is.
+type slowStartBody struct {
+	io.ReadCloser
+	limiter *rateLimitedReader
+	initial int64
+	start   time.Time
+	ramp    time.Duration
+}
+
+// slowStartDoublings spreads over the whole ramp; at the 512KB/s default
+// the cap reaches 512MB/s just before the ramp ends.
+const slowStartDoublings = 10
+
+func newSlowStartBody(ctx context.Context, body io.ReadCloser, initial int64, ramp time.Duration) *slowStartBody {
+	return &slowStartBody{
+		ReadCloser: body,
+		limiter:    newRateLimitedReader(ctx, body, initial),
+		initial:    initial,
+		start:      time.Now(),
+		ramp:       ramp,
+	}
 }
 
-func getBuffer() *[]byte {
-	return bufferPool.Get().(*[]byte)
+// rateAt is the read rate elapsed into the ramp.
+func (b *slowStartBody) rateAt(elapsed time.Duration) int64 {
+	frac := math.Min(float64(elapsed)/float64(b.ramp), 1)
+	return int64(float64(b.initial) * math.Exp2(slowStartDoublings*frac))
 }
 
-func putBuffer(buf *[]byte) {
-	bufferPool.Put(buf)
+func (b *slowStartBody) Read(p []byte) (int, error) {
+	elapsed := time.Since(b.start)
+	if elapsed >= b.ramp {
+		return b.ReadCloser.Read(p)
+	}
+	if rate := b.rateAt(elapsed); rate > b.limiter.rate {
+		b.limiter.rate = rate
+	}
+	return b.limiter.Read(p)
+}
+
+// downloadRate resolves the effective rate for a download: the client's
+// ?rateLimit= clamped to MaxDownloadRate, or MaxDownloadRate by default.
+func (fr *FileRelay) downloadRate(r *http.Request) int64 {
+	rate := fr.cfg.MaxDownloadRate
+	if v := r.URL.Query().Get("rateLimit"); v != "" {
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil && n > 0 {
+			if rate == 0 || n < rate {
+				rate = n
+			}
+		}
+	}
+	return rate
 }
 
 // ============================================
@@ -118,29 +660,331 @@ func putBuffer(buf *[]byte) {
 type Peer struct {
 	ID          string
 	Conn        *websocket.Conn
-	IsHost      bool
+	host        atomic.Bool // flipped by transfer-host
 	RoomCode    string
 	IP          string
 	ConnectedAt time.Time
 	MsgCount    int64
 	LastMsgTime time.Time
+	missedPongs atomic.Int32
+	closed      atomic.Bool
 	mu          sync.Mutex
+
+	// Sent only to this peer in room-joined; a later join with the same
+	// peer_id must present it to replace this connection
+	reconnectToken string
+
+	// Traffic counters, for telling a silent client from an undeliverable one
+	recvMsgs  atomic.Int64
+	recvBytes atomic.Int64
+	sentMsgs  atomic.Int64
+	sentBytes atomic.Int64
+	dropped   atomic.Int64 // messages not delivered (closed or failed write)
+
+	// Opt-in send coalescing: messages queued within batchWindow go out as
+	// one {"type":"batch","messages":[...]} frame. Zero sends immediately.
+	batchWindow    time.Duration
+	batchMu        sync.Mutex
+	batchPending   []json.RawMessage
+	batchScheduled bool
+
+	// Recently seen client msgIds, owned by the read loop
+	seenIDs   map[string]time.Time
+	seenOrder []string
+
+	relayTicket string // last request-relay ticket, owned by the read loop
+
+	// Bytes actually written to the socket, frames and compression included
+	wire    *countingConn
+	deflate bool // permessage-deflate negotiated
+	dict    bool // dictSubprotocol negotiated: frames are dictionary-deflated
+
+	// Adaptive ping state, see nextPing
+	pingMu       sync.Mutex
+	pingInterval time.Duration
+	pingSentAt   time.Time
+	srtt         time.Duration // smoothed pong round trip
+	rttvar       time.Duration // smoothed deviation of the round trip
+}
+
+// countingConn counts bytes written to the hijacked connection.
+type countingConn struct {
+	net.Conn
+	written atomic.Int64
+	totals  *deflateTotals // server-wide sums, set for permessage-deflate peers
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.written.Add(int64(n))
+	if c.totals != nil {
+		c.totals.wire.Add(int64(n))
+	}
+	return n, err
+}
+
+// deflateTotals sums payload and wire bytes over every permessage-deflate
+// connection, for the compression ratio in /api/stats.
+type deflateTotals struct {
+	payload atomic.Int64
+	wire    atomic.Int64
+}
+
+// countingHijacker hands the upgrader a countingConn in place of the raw
+// connection, so what permessage-deflate saves can be measured.
+type countingHijacker struct {
+	http.ResponseWriter
+	conn *countingConn
 }
 
+func (h *countingHijacker) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := h.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response does not implement http.Hijacker")
+	}
+	c, brw, err := hj.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	h.conn = &countingConn{Conn: c}
+	return h.conn, brw, nil
+}
+
+const maxSeenMsgIDs = 256
+
+// isDuplicate records msgID and reports whether it was already seen within
+// window. Only called from the peer's own read loop.
+func (p *Peer) isDuplicate(msgID string, window time.Duration) bool {
+	now := time.Now()
+	for len(p.seenOrder) > 0 {
+		oldest := p.seenOrder[0]
+		if now.Sub(p.seenIDs[oldest]) < window && len(p.seenOrder) < maxSeenMsgIDs {
+			break
+		}
+		delete(p.seenIDs, oldest)
+		p.seenOrder = p.seenOrder[1:]
+	}
+
+	if _, ok := p.seenIDs[msgID]; ok {
+		return true
+	}
+	if p.seenIDs == nil {
+		p.seenIDs = make(map[string]time.Time)
+	}
+	p.seenIDs[msgID] = now
+	p.seenOrder = append(p.seenOrder, msgID)
+	return false
+}
+
+var errPeerClosed = errors.New("peer connection closed")
+
+// SendJSON writes v to the peer. A failed write marks the peer dead, which
+// closes its socket so its own read loop exits and runs RemovePeer; callers
+// broadcasting inside Peers.Range never remove peers themselves.
 func (p *Peer) SendJSON(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if p.closed.Load() {
+		p.dropped.Add(1)
+		return errPeerClosed
+	}
+	if p.batchWindow > 0 {
+		p.enqueue(data)
+		return nil
+	}
+	return p.write(data, 1)
+}
+
+// write sends one frame carrying count messages.
+func (p *Peer) write(data []byte, count int) error {
 	p.mu.Lock()
 	defer p.mu.Unlock()
-	p.Conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
-	return p.Conn.WriteJSON(v)
+	// Without a deadline a stuck socket could block this writer, and
+	// every sender queued on p.mu, indefinitely; give up on the peer.
+	// websocket.Conn only records the deadline and ignores the socket's
+	// error when applying it, so check it on the socket itself.
+	deadline := time.Now().Add(10 * time.Second)
+	p.Conn.SetWriteDeadline(deadline)
+	if err := p.Conn.NetConn().SetWriteDeadline(deadline); err != nil {
+		p.dropped.Add(int64(count))
+		p.markDead()
+		return err
+	}
+	frameType, frame := websocket.TextMessage, data
+	if p.dict {
+		frameType, frame = websocket.BinaryMessage, dictCompress(data)
+	}
+	if err := p.Conn.WriteMessage(frameType, frame); err != nil {
+		p.dropped.Add(int64(count))
+		p.markDead()
+		return err
+	}
+	p.sentMsgs.Add(int64(count))
+	p.sentBytes.Add(int64(len(data)))
+	if p.wire != nil && p.wire.totals != nil {
+		p.wire.totals.payload.Add(int64(len(data)))
+	}
+	return nil
+}
+
+const maxBatchMessages = 256
+
+// enqueue adds data to the pending batch, arming a flush after batchWindow.
+// A full batch is flushed right away by the caller.
+func (p *Peer) enqueue(data []byte) {
+	p.batchMu.Lock()
+	p.batchPending = append(p.batchPending, data)
+	full := len(p.batchPending) >= maxBatchMessages
+	if !full && !p.batchScheduled {
+		p.batchScheduled = true
+		time.AfterFunc(p.batchWindow, p.flushBatch)
+	}
+	p.batchMu.Unlock()
+	if full {
+		p.flushBatch()
+	}
+}
+
+func (p *Peer) flushBatch() {
+	p.batchMu.Lock()
+	msgs := p.batchPending
+	p.batchPending = nil
+	p.batchScheduled = false
+	p.batchMu.Unlock()
+
+	switch {
+	case len(msgs) == 0:
+	case p.closed.Load():
+		p.dropped.Add(int64(len(msgs)))
+	case len(msgs) == 1:
+		p.write(msgs[0], 1)
+	default:
+		data, _ := json.Marshal(map[string]interface{}{
+			"type":     "batch",
+			"messages": msgs,
+		})
+		p.write(data, len(msgs))
+	}
+}
+
+// Stats snapshots the peer's connection details and traffic counters.
+func (p *Peer) Stats() map[string]interface{} {
+	return map[string]interface{}{
+		"peerId":       p.ID,
+		"isHost":       p.IsHost(),
+		"ip":           p.IP,
+		"connectedAt":  p.ConnectedAt.Unix(),
+		"recvMessages": p.recvMsgs.Load(),
+		"recvBytes":    p.recvBytes.Load(),
+		"sentMessages": p.sentMsgs.Load(),
+		"sentBytes":    p.sentBytes.Load(),
+		"dropped":      p.dropped.Load(),
+		"missedPongs":  p.missedPongs.Load(),
+	}
+}
+
+func (p *Peer) IsHost() bool {
+	return p.host.Load()
+}
+
+// pinged records when a ping went out, for timing its pong.
+func (p *Peer) pinged() {
+	p.pingMu.Lock()
+	p.pingSentAt = time.Now()
+	p.pingMu.Unlock()
+}
+
+// ponged folds the round trip of the last ping into srtt and rttvar, with
+// the same gains TCP uses (RFC 6298).
+func (p *Peer) ponged() {
+	p.pingMu.Lock()
+	defer p.pingMu.Unlock()
+	if p.pingSentAt.IsZero() {
+		return
+	}
+	rtt := time.Since(p.pingSentAt)
+	p.pingSentAt = time.Time{}
+	if p.srtt == 0 {
+		p.srtt, p.rttvar = rtt, rtt/2
+		return
+	}
+	diff := p.srtt - rtt
+	if diff < 0 {
+		diff = -diff
+	}
+	p.rttvar = (3*p.rttvar + diff) / 4
+	p.srtt = (7*p.srtt + rtt) / 8
+}
+
+// Round-trip deviation below this is noise, not a flaky link
+const minPingJitter = 20 * time.Millisecond
+
+// nextPing returns how long to wait before the next ping. A missed pong
+// or a jittery round trip halves the interval so a dead link is noticed
+// sooner; a steady one grows it by a quarter, to save pings on good links.
+// The result stays within [min, max].
+func (p *Peer) nextPing(min, max time.Duration) time.Duration {
+	p.pingMu.Lock()
+	defer p.pingMu.Unlock()
+	switch {
+	case p.missedPongs.Load() > 0, p.rttvar > p.srtt/2 && p.rttvar > minPingJitter:
+		p.pingInterval /= 2
+	case p.srtt > 0:
+		p.pingInterval += p.pingInterval / 4
+	}
+	if p.pingInterval < min {
+		p.pingInterval = min
+	}
+	if p.pingInterval > max {
+		p.pingInterval = max
+	}
+	return p.pingInterval
+}
+
+func (p *Peer) srttMillis() int64 {
+	p.pingMu.Lock()
+	defer p.pingMu.Unlock()
+	return p.srtt.Milliseconds()
+}
+
+func (p *Peer) pingIntervalMillis() int64 {
+	p.pingMu.Lock()
+	defer p.pingMu.Unlock()
+	return p.pingInterval.Milliseconds()
+}
+
+// markDead closes the peer's connection once; safe to call concurrently
+// with writers since Conn.Close doesn't take p.mu.
+func (p *Peer) markDead() {
+	if p.closed.CompareAndSwap(false, true) {
+		p.Conn.Close()
+	}
 }
 
 type Room struct {
-	Code         string
-	Peers        sync.Map // map[string]*Peer
-	CreatedAt    time.Time
-	LastActivity atomic.Value // time.Time
-	MessageCount atomic.Int64
-	peerCount    atomic.Int32
+	Code           string
+	CreatedByIP    string   // counted against MaxRoomsPerIP until the room is removed
+	Peers          sync.Map // map[string]*Peer
+	CreatedAt      time.Time
+	LastActivity   atomic.Value // time.Time
+	LastRelay      atomic.Int64 // unix nanos of the last join or relayed message
+	MessageCount   atomic.Int64
+	peerCount      atomic.Int32
+	offers         sync.Map // map[offerId]senderID, pending transfer-offers
+	renegotiateSeq atomic.Int64
+	streams        sync.Map // map[streamId]*stream, in-band chunked transfers
+	budget         roomBudget
+	relaySeq       int64      // last stamped seq, guarded by relayMu
+	relayMu        sync.Mutex // held across stamping and fan-out when StampMessages is on
+	MaxMessageSize int64      // per-room read limit set at creation, 0 = server MaxMessageSize
+	kvMu           sync.Mutex
+	kv             map[string]json.RawMessage // /api/rooms/{code}/kv, guarded by kvMu
+	kvBytes        int
+	heldMu         sync.Mutex
+	held           map[string][]*heldMessage // by target peer ID, for the queue absent-target policy
+	heldCount      int                       // entries across held, bounded by maxHeldPerRoom
 }
 
 func NewRoom(code string) *Room {
@@ -149,12 +993,21 @@ func NewRoom(code string) *Room {
 		CreatedAt: time.Now(),
 	}
 	r.LastActivity.Store(time.Now())
+	r.LastRelay.Store(time.Now().UnixNano())
 	return r
 }
 
-func (r *Room) IsExpired() bool {
+// readLimit is the largest message peers in r may send.
+func (r *Room) readLimit(serverMax int64) int64 {
+	if r.MaxMessageSize > 0 {
+		return r.MaxMessageSize
+	}
+	return serverMax
+}
+
+func (r *Room) IsExpired(timeout time.Duration) bool {
 	la := r.LastActivity.Load().(time.Time)
-	return time.Since(la) > cfg.RoomTimeout
+	return time.Since(la) > timeout
 }
 
 func (r *Room) PeerCount() int {
@@ -165,182 +1018,895 @@ func (r *Room) Touch() {
 	r.LastActivity.Store(time.Now())
 }
 
+// IsIdle reports whether nothing has been relayed for timeout (0 = never).
+// Keepalive pings never update LastRelay, so they can't hold a room open.
+func (r *Room) IsIdle(timeout time.Duration) bool {
+	if timeout <= 0 {
+		return false
+	}
+	return time.Since(time.Unix(0, r.LastRelay.Load())) > timeout
+}
+
 // ============================================
 // Room Manager
 // ============================================
 
 type RoomManager struct {
-	rooms           sync.Map // map[string]*Room
-	ipConnections   sync.Map // map[string]*atomic.Int32
+	cfg             *Config
+	rooms           sync.Map   // map[string]*Room
+	limits          LimitStore // "conn:{ip}" and "rooms:{ip}" gauges, "msg:{room}:{peer}" windows
 	totalMessages   atomic.Int64
 	totalConns      atomic.Int64
 	totalBytesRelay atomic.Int64
 	startTime       time.Time
+	cluster         *clusterBus     // nil unless SENDIT_GO_REDIS_URL is set
+	tombstones      sync.Map        // map[string]time.Time, codes of closed rooms held back until then
+	reserved        map[string]bool // SENDIT_GO_RESERVED_CODES, read-only after startup
+	deflate         deflateTotals
+	roomCount       atomic.Int64 // rooms in the registry, held to MaxRooms
+	lifetimes       lifetimeHistogram
+}
+
+// lifetimeBounds are the upper bounds of the room lifetime histogram
+// buckets; a last, unbounded bucket catches everything longer.
+var lifetimeBounds = []time.Duration{
+	10 * time.Second, 30 * time.Second, time.Minute, 2 * time.Minute,
+	5 * time.Minute, 10 * time.Minute, 15 * time.Minute, 30 * time.Minute,
+	time.Hour, 2 * time.Hour, 6 * time.Hour, 24 * time.Hour,
+}
+
+// lifetimeHistogram records how long removed rooms lived, from CreatedAt
+// to deletion, for tuning RoomTimeout.
+type lifetimeHistogram struct {
+	mu      sync.Mutex
+	buckets [13]int64 // len(lifetimeBounds)+1
+	count   int64
+	sum     time.Duration
+	max     time.Duration
+}
+
+func (h *lifetimeHistogram) observe(d time.Duration) {
+	i := sort.Search(len(lifetimeBounds), func(i int) bool { return d <= lifetimeBounds[i] })
+	h.mu.Lock()
+	h.buckets[i]++
+	h.count++
+	h.sum += d
+	if d > h.max {
+		h.max = d
+	}
+	h.mu.Unlock()
+}
+
+// stats reports the average and an estimated p99: the upper bound of the
+// bucket holding the 99th percentile, or the longest lifetime seen if
+// that is smaller or the percentile falls in the unbounded bucket.
+func (h *lifetimeHistogram) stats() map[string]interface{} {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var avg, p99 time.Duration
+	if h.count > 0 {
+		avg = h.sum / time.Duration(h.count)
+		rank := (h.count*99 + 99) / 100 // ceil(0.99 * count)
+		var seen int64
+		p99 = h.max
+		for i, n := range h.buckets[:len(lifetimeBounds)] {
+			if seen += n; seen >= rank {
+				if lifetimeBounds[i] < h.max {
+					p99 = lifetimeBounds[i]
+				}
+				break
+			}
+		}
+	}
+	return map[string]interface{}{
+		"rooms":      h.count,
+		"avgSeconds": avg.Seconds(),
+		"p99Seconds": p99.Seconds(),
+		"maxSeconds": h.max.Seconds(),
+	}
 }
 
-func NewRoomManager() *RoomManager {
-	return &RoomManager{
+func NewRoomManager(cfg *Config) (*RoomManager, error) {
+	limits, err := NewLimitStore(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("limit store init: %w", err)
+	}
+	rm := &RoomManager{
+		cfg:       cfg,
+		limits:    limits,
 		startTime: time.Now(),
+		reserved:  make(map[string]bool, len(cfg.ReservedCodes)),
+	}
+	for _, code := range cfg.ReservedCodes {
+		rm.reserved[strings.ToUpper(code)] = true
 	}
+	if cfg.RedisURL != "" {
+		cluster, err := newClusterBus(rm)
+		if err != nil {
+			return nil, fmt.Errorf("redis cluster init: %w", err)
+		}
+		rm.cluster = cluster
+	}
+	return rm, nil
 }
 
 const roomCodeChars = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
 
+// codeFilterWords are substrings a generated code must not contain when
+// SENDIT_GO_CODE_FILTER is on. The alphabet has no I, O, 0 or 1, so only
+// words spelled without them (or with digit look-alikes) can come up.
+var codeFilterWords = []string{
+	"ANAL", "ANUS", "ASS", "A55", "CRAP", "CUM", "CUNT", "DAMN", "FAG",
+	"FCK", "FUCK", "FUK", "KKK", "PUSSY", "RAPE", "SEX", "5EX", "SHT",
+	"SLUT", "STFU", "TURD", "TWAT", "WANK", "WTF",
+}
+
+// Reserved reports whether code is on the SENDIT_GO_RESERVED_CODES list,
+// which can never be generated, created or joined.
+func (rm *RoomManager) Reserved(code string) bool {
+	return rm.reserved[code]
+}
+
+// issuable reports whether a freshly generated code may be handed out.
+func (rm *RoomManager) issuable(code string) bool {
+	if rm.Reserved(code) || rm.Tombstoned(code) {
+		return false
+	}
+	if rm.cfg.CodeFilter {
+		for _, word := range codeFilterWords {
+			if strings.Contains(code, word) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
 func (rm *RoomManager) GenerateRoomCode() string {
 	max := big.NewInt(int64(len(roomCodeChars)))
 	for {
-		code := make([]byte, cfg.RoomCodeLength)
+		code := make([]byte, rm.cfg.RoomCodeLength)
 		for i := range code {
 			n, _ := rand.Int(rand.Reader, max)
 			code[i] = roomCodeChars[n.Int64()]
 		}
 		codeStr := string(code)
-		if _, ok := rm.rooms.Load(codeStr); !ok {
+		if _, ok := rm.rooms.Load(codeStr); !ok && rm.issuable(codeStr) {
 			return codeStr
 		}
 	}
 }
 
-func (rm *RoomManager) CreateRoom() string {
-	code := rm.GenerateRoomCode()
-	rm.rooms.Store(code, NewRoom(code))
-	return code
+// NormalizeCode upper-cases code and reports whether it matches the
+// configured length and the roomCodeChars alphabet.
+func (rm *RoomManager) NormalizeCode(code string) (string, bool) {
+	code = strings.ToUpper(code)
+	if len(code) != rm.cfg.RoomCodeLength {
+		return code, false
+	}
+	for i := 0; i < len(code); i++ {
+		if strings.IndexByte(roomCodeChars, code[i]) < 0 {
+			return code, false
+		}
+	}
+	return code, true
 }
 
-func (rm *RoomManager) GetRoom(code string) *Room {
-	code = strings.ToUpper(code)
-	val, ok := rm.rooms.Load(code)
-	if !ok {
-		return nil
+// CreateRoom creates a room on behalf of ip, returning false when ip
+// already owns MaxRoomsPerIP rooms. maxMessageSize is the room's read
+// limit, 0 for the server default.
+func (rm *RoomManager) CreateRoom(ip string, maxMessageSize int64) (string, bool) {
+	if rm.reserveRoom(ip) != nil {
+		return "", false
 	}
-	room := val.(*Room)
-	if room.IsExpired() {
-		rm.rooms.Delete(code)
-		return nil
+	for {
+		code := rm.GenerateRoomCode()
+		room := NewRoom(code)
+		room.CreatedByIP = ip
+		room.MaxMessageSize = maxMessageSize
+		if _, loaded := rm.rooms.LoadOrStore(code, room); !loaded {
+			return code, true
+		}
 	}
-	return room
 }
 
-func (rm *RoomManager) AddPeer(room *Room, peer *Peer) {
-	room.Peers.Store(peer.ID, peer)
-	room.peerCount.Add(1)
-	room.Touch()
-	rm.totalConns.Add(1)
+var (
+	errRoomTaken    = errors.New("room code already in use")
+	errTooManyRooms = errors.New("too many rooms")
+	errRoomLimit    = errors.New("server room limit reached")
+)
 
-	// Track IP
-	val, _ := rm.ipConnections.LoadOrStore(peer.IP, &atomic.Int32{})
-	val.(*atomic.Int32).Add(1)
+// ClaimRoom creates a room with a caller-chosen code, which must already
+// be normalized. It fails with errRoomTaken if the code is live here or,
+// when clustered, on another instance.
+func (rm *RoomManager) ClaimRoom(ip, code string, maxMessageSize int64) error {
+	if rm.Tombstoned(code) || rm.cluster != nil && rm.cluster.Exists(code) {
+		return errRoomTaken
+	}
+	if err := rm.reserveRoom(ip); err != nil {
+		return err
+	}
+	room := NewRoom(code)
+	room.CreatedByIP = ip
+	room.MaxMessageSize = maxMessageSize
+	if _, loaded := rm.rooms.LoadOrStore(code, room); loaded {
+		rm.releaseRoom(ip)
+		return errRoomTaken
+	}
+	return nil
+}
 
-	// Notify other peers
-	room.Peers.Range(func(key, value interface{}) bool {
-		pid := key.(string)
-		p := value.(*Peer)
-		if pid != peer.ID {
-			p.SendJSON(map[string]interface{}{
-				"type":      "peer-joined",
-				"peerId":    peer.ID,
-				"isHost":    peer.IsHost,
-				"peerCount": room.PeerCount(),
-			})
-		}
+// GetOrCreateRoom returns the live room for code, or creates it for a
+// host connecting to a code nobody holds yet. The slot is reserved before
+// the LoadOrStore, so concurrent creates can neither pass MaxRooms nor
+// install two rooms under one code; the loser joins the winner's room.
+func (rm *RoomManager) GetOrCreateRoom(ip, code string) (room *Room, created bool, err error) {
+	if room := rm.GetRoom(code); room != nil {
+		return room, false, nil
+	}
+	if err := rm.reserveRoom(ip); err != nil {
+		return nil, false, err
+	}
+	room = NewRoom(code)
+	room.CreatedByIP = ip
+	if val, loaded := rm.rooms.LoadOrStore(code, room); loaded {
+		rm.releaseRoom(ip)
+		return val.(*Room), false, nil
+	}
+	return room, true, nil
+}
+
+// reserveRoom takes one of ip's MaxRoomsPerIP slots and one of the
+// server's MaxRooms. Every room in the registry holds both until
+// discardRoom gives them back.
+func (rm *RoomManager) reserveRoom(ip string) error {
+	if !rm.reserveRoomSlot(ip) {
+		return errTooManyRooms
+	}
+	if rm.roomCount.Add(1) > int64(rm.cfg.MaxRooms) {
+		rm.roomCount.Add(-1)
+		rm.limits.Adjust("rooms:"+ip, -1)
+		return errRoomLimit
+	}
+	return nil
+}
+
+// releaseRoom undoes reserveRoom for a room that was never stored.
+func (rm *RoomManager) releaseRoom(ip string) {
+	rm.roomCount.Add(-1)
+	rm.limits.Adjust("rooms:"+ip, -1)
+}
+
+// CanCreateRoom reports whether ip is below MaxRoomsPerIP.
+func (rm *RoomManager) CanCreateRoom(ip string) bool {
+	if rm.cfg.MaxRoomsPerIP <= 0 {
 		return true
-	})
+	}
+	return rm.limits.Count("rooms:"+ip) < int64(rm.cfg.MaxRoomsPerIP)
+}
+
+func (rm *RoomManager) reserveRoomSlot(ip string) bool {
+	if rm.limits.Adjust("rooms:"+ip, 1) > int64(rm.cfg.MaxRoomsPerIP) && rm.cfg.MaxRoomsPerIP > 0 {
+		rm.limits.Adjust("rooms:"+ip, -1)
+		return false
+	}
+	return true
+}
+
+// deleteRoom removes room from the registry exactly once, releasing its
+// creator's MaxRoomsPerIP slot, and tombstones its code.
+func (rm *RoomManager) deleteRoom(room *Room) {
+	if !rm.discardRoom(room) {
+		return
+	}
+	rm.lifetimes.observe(time.Since(room.CreatedAt))
+	if rm.cfg.RoomTombstone > 0 {
+		rm.tombstones.Store(room.Code, time.Now().Add(rm.cfg.RoomTombstone))
+	}
+}
+
+// discardRoom is deleteRoom without the tombstone, for a room that never
+// got a peer, so no client can be holding its code.
+func (rm *RoomManager) discardRoom(room *Room) bool {
+	if !rm.rooms.CompareAndDelete(room.Code, room) {
+		return false
+	}
+	rm.roomCount.Add(-1)
+	if room.CreatedByIP != "" {
+		rm.limits.Adjust("rooms:"+room.CreatedByIP, -1)
+	}
+	return true
+}
+
+// Tombstoned reports whether code belongs to a room closed less than
+// RoomTombstone ago. Such codes are not reissued, and joins get
+// ROOM_CLOSED, so a stale client can't land in an unrelated new room.
+func (rm *RoomManager) Tombstoned(code string) bool {
+	val, ok := rm.tombstones.Load(code)
+	if !ok {
+		return false
+	}
+	if time.Now().After(val.(time.Time)) {
+		rm.tombstones.CompareAndDelete(code, val)
+		return false
+	}
+	return true
+}
+
+func (rm *RoomManager) GetRoom(code string) *Room {
+	code = strings.ToUpper(code)
+	val, ok := rm.rooms.Load(code)
+	if !ok {
+		// Room may live on another instance; attach a local shell for it
+		if rm.cluster == nil || !rm.cluster.Exists(code) {
+			return nil
+		}
+		var loaded bool
+		if val, loaded = rm.rooms.LoadOrStore(code, NewRoom(code)); !loaded {
+			rm.roomCount.Add(1) // counted, but a shell is never refused
+		}
+	}
+	room := val.(*Room)
+	if room.IsExpired(rm.cfg.RoomTimeout) {
+		rm.deleteRoom(room)
+		return nil
+	}
+	return room
+}
 
-	// Collect existing peer IDs
-	var peerIDs []string
+// TotalPeers counts the room's peers across every instance. The shared
+// roster can lag this instance's own peers (or be lost with Redis), so it
+// never counts fewer than are connected here.
+func (rm *RoomManager) TotalPeers(room *Room) int {
+	local := room.PeerCount()
+	if rm.cluster != nil {
+		if n := len(rm.cluster.Roster(room.Code)); n > local {
+			return n
+		}
+	}
+	return local
+}
+
+func (rm *RoomManager) AddPeer(room *Room, peer *Peer) {
+	room.Peers.Store(peer.ID, peer)
+	room.peerCount.Add(1)
+	room.Touch()
+	room.LastRelay.Store(time.Now().UnixNano())
+	rm.totalConns.Add(1)
+	if rm.cluster != nil {
+		rm.cluster.Join(room.Code, peer.ID)
+	}
+	peerCount := rm.TotalPeers(room)
+
+	// Track IP
+	rm.limits.Adjust("conn:"+peer.IP, 1)
+
+	// Perfect-negotiation roles, by join order: between any two peers the
+	// one already in the room is impolite and the newcomer is polite, so on
+	// glare exactly one side rolls back its offer. "polite" in peer-joined
+	// is the receiver's role toward the newcomer.
+	joined := map[string]interface{}{
+		"type":      "peer-joined",
+		"peerId":    peer.ID,
+		"isHost":    peer.IsHost(),
+		"peerCount": peerCount,
+		"polite":    false,
+	}
 	room.Peers.Range(func(key, value interface{}) bool {
 		pid := key.(string)
+		p := value.(*Peer)
 		if pid != peer.ID {
-			peerIDs = append(peerIDs, pid)
+			p.SendJSON(joined)
 		}
 		return true
 	})
+	if rm.cluster != nil {
+		rm.cluster.Publish(room.Code, peer.ID, "", joined)
+	}
 
 	// Send room info to new peer
+	peers := rm.PeerIDs(room, peer.ID)
 	peer.SendJSON(map[string]interface{}{
-		"type":      "room-joined",
-		"roomCode":  room.Code,
-		"peerId":    peer.ID,
-		"isHost":    peer.IsHost,
-		"peerCount": room.PeerCount(),
-		"peers":     peerIDs,
+		"type":           "room-joined",
+		"roomCode":       room.Code,
+		"peerId":         peer.ID,
+		"isHost":         peer.IsHost(),
+		"peerCount":      peerCount,
+		"peers":          peers,
+		"maxMessageSize": room.readLimit(rm.cfg.MaxMessageSize),
+		"polite":         len(peers) > 0,
+		"reconnectToken": peer.reconnectToken,
 	})
+
+	// Operator notice; sent directly, so it never touches relay counters
+	if rm.cfg.MOTD != "" {
+		peer.SendJSON(rm.cfg.brand(map[string]interface{}{
+			"type":    "notice",
+			"message": rm.cfg.MOTD,
+		}))
+	}
+
+	rm.deliverHeld(room, peer)
 }
 
-func (rm *RoomManager) RemovePeer(room *Room, peerID string) {
-	val, ok := room.Peers.LoadAndDelete(peerID)
-	if !ok {
+// Broadcast sends msg to every peer in the room, on every instance.
+func (rm *RoomManager) Broadcast(room *Room, msg map[string]interface{}) {
+	room.Peers.Range(func(_, value interface{}) bool {
+		value.(*Peer).SendJSON(msg)
+		return true
+	})
+	if rm.cluster != nil {
+		rm.cluster.Publish(room.Code, "", "", msg)
+	}
+}
+
+// CloseRoom removes room and disconnects everyone in it with
+// {"type":"room-closed","by":by} followed by a normal close frame. Peers on
+// other instances get the message and are expected to leave.
+func (rm *RoomManager) CloseRoom(room *Room, by string) {
+	rm.deleteRoom(room)
+	closed := map[string]interface{}{
+		"type": "room-closed",
+		"by":   by,
+	}
+	room.Peers.Range(func(_, value interface{}) bool {
+		p := value.(*Peer)
+		p.SendJSON(closed)
+		p.flushBatch()
+		p.Conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseNormalClosure, "room-closed"),
+			time.Now().Add(time.Second))
+		p.markDead()
+		return true
+	})
+	if rm.cluster != nil {
+		rm.cluster.Publish(room.Code, "", "", closed)
+	}
+}
+
+// PeerIDs lists the room's peers across every instance, minus exclude.
+func (rm *RoomManager) PeerIDs(room *Room, exclude string) []string {
+	peerIDs := []string{}
+	if rm.cluster != nil {
+		for pid := range rm.cluster.Roster(room.Code) {
+			if pid != exclude {
+				peerIDs = append(peerIDs, pid)
+			}
+		}
+		return peerIDs
+	}
+	room.Peers.Range(func(key, value interface{}) bool {
+		if pid := key.(string); pid != exclude {
+			peerIDs = append(peerIDs, pid)
+		}
+		return true
+	})
+	return peerIDs
+}
+
+// RemovePeer removes peer from room. It is a no-op if peer's ID has since
+// been taken over by a reconnecting connection.
+func (rm *RoomManager) RemovePeer(room *Room, peer *Peer) {
+	if !room.Peers.CompareAndDelete(peer.ID, peer) {
 		return
 	}
 	room.peerCount.Add(-1)
-	peer := val.(*Peer)
+	peerID := peer.ID
+	room.dropStreams(peerID)
+	room.dropOffers(peerID)
 
 	// Update IP count
-	if v, ok := rm.ipConnections.Load(peer.IP); ok {
-		v.(*atomic.Int32).Add(-1)
+	rm.limits.Adjust("conn:"+peer.IP, -1)
+
+	if rm.cluster != nil {
+		rm.cluster.Leave(room.Code, peerID)
 	}
 
 	// Notify remaining peers
+	left := map[string]interface{}{
+		"type":      "peer-left",
+		"peerId":    peerID,
+		"peerCount": rm.TotalPeers(room),
+	}
 	room.Peers.Range(func(key, value interface{}) bool {
 		p := value.(*Peer)
-		p.SendJSON(map[string]interface{}{
-			"type":      "peer-left",
-			"peerId":    peerID,
-			"peerCount": room.PeerCount(),
-		})
+		p.SendJSON(left)
 		return true
 	})
+	if rm.cluster != nil {
+		rm.cluster.Publish(room.Code, peerID, "", left)
+	}
 
 	// If empty, remove room
 	if room.PeerCount() == 0 {
-		rm.rooms.Delete(room.Code)
+		rm.deleteRoom(room)
+	}
+}
+
+// evictStale quietly drops old so a reconnecting client can take over its
+// peer ID; the replacement's AddPeer announces the rejoin.
+func (rm *RoomManager) evictStale(room *Room, old *Peer) {
+	if !room.Peers.CompareAndDelete(old.ID, old) {
+		return
+	}
+	room.peerCount.Add(-1)
+	rm.limits.Adjust("conn:"+old.IP, -1)
+	old.markDead()
+}
+
+const maxPeerIDLength = 64
+
+// validPeerID accepts 1-64 characters of [A-Za-z0-9_-].
+func validPeerID(id string) bool {
+	if id == "" || len(id) > maxPeerIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		c := id[i]
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// roomBudget caps a room's combined relay traffic in one-second windows,
+// catching cooperating peers that each stay under per-peer limits.
+type roomBudget struct {
+	mu        sync.Mutex
+	window    time.Time
+	msgs      int
+	bytes     int64
+	throttled bool
+}
+
+// spend charges one message of size bytes. It returns false when the room
+// is over budget, and notify is true for the first refusal in a window.
+func (b *roomBudget) spend(size int, maxMsgs int, maxBytes int64) (ok, notify bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	if now.Sub(b.window) >= time.Second {
+		b.window, b.msgs, b.bytes, b.throttled = now, 0, 0, false
 	}
+	if maxMsgs > 0 && b.msgs >= maxMsgs || maxBytes > 0 && b.bytes+int64(size) > maxBytes {
+		notify = !b.throttled
+		b.throttled = true
+		return false, notify
+	}
+	b.msgs++
+	b.bytes += int64(size)
+	return true, false
 }
 
-func (rm *RoomManager) RelayMessage(room *Room, senderID string, msg map[string]interface{}) {
+// RelayMessage forwards msg (size bytes on the wire) from senderID. Over
+// the room's budget the message is dropped and peers get room-throttled.
+func (rm *RoomManager) RelayMessage(room *Room, senderID string, msg map[string]interface{}, size int) {
+	if ok, notify := room.budget.spend(size, rm.cfg.RoomMsgPerSecond, rm.cfg.RoomBytesPerSecond); !ok {
+		if notify {
+			throttled := map[string]interface{}{
+				"type":         "room-throttled",
+				"retryAfterMs": 1000,
+			}
+			room.Peers.Range(func(_, value interface{}) bool {
+				value.(*Peer).SendJSON(throttled)
+				return true
+			})
+		}
+		return
+	}
+
 	room.Touch()
+	room.LastRelay.Store(time.Now().UnixNano())
 	room.MessageCount.Add(1)
 	rm.totalMessages.Add(1)
 
-	targetID, _ := msg["targetId"].(string)
 	msg["senderId"] = senderID
 
-	room.Peers.Range(func(key, value interface{}) bool {
-		pid := key.(string)
-		if pid == senderID {
-			return true
+	// Stamping and fan-out happen under one lock, so every peer sees
+	// stamped messages in serverSeq order even with concurrent senders.
+	// ("seq" is left alone: stream-chunk and renegotiate already use it.)
+	if rm.cfg.StampMessages {
+		room.relayMu.Lock()
+		defer room.relayMu.Unlock()
+		room.relaySeq++
+		msg["serverSeq"] = room.relaySeq
+		msg["serverTs"] = time.Now().UnixMilli()
+	}
+
+	targets, multi := relayTargets(msg, senderID)
+	if len(targets) > maxRelayTargets {
+		if val, ok := room.Peers.Load(senderID); ok {
+			val.(*Peer).SendJSON(map[string]interface{}{
+				"type":    "error",
+				"code":    "TOO_MANY_TARGETS",
+				"message": fmt.Sprintf("At most %d targetIds per message", maxRelayTargets),
+			})
 		}
-		if targetID != "" && pid != targetID {
+		return
+	}
+	if targets == nil {
+		// Broadcast to everyone but the sender
+		room.Peers.Range(func(key, value interface{}) bool {
+			if key.(string) == senderID {
+				return true
+			}
+			value.(*Peer).SendJSON(msg)
 			return true
+		})
+		if rm.cluster != nil {
+			rm.cluster.Publish(room.Code, senderID, "", msg)
 		}
-		p := value.(*Peer)
-		p.SendJSON(msg)
-		return true
+		return
+	}
+
+	policy := rm.cfg.AbsentTarget
+	if p, _ := msg["onAbsent"].(string); validAbsentPolicy(p) {
+		policy = p
+	}
+
+	var unknown, absent []string
+	for _, id := range targets {
+		if val, ok := room.Peers.Load(id); ok {
+			val.(*Peer).SendJSON(msg)
+			continue
+		}
+		if rm.cluster != nil && rm.cluster.Publish(room.Code, senderID, id, msg) {
+			continue
+		}
+		if policy == absentQueue {
+			absent = append(absent, id)
+			continue
+		}
+		unknown = append(unknown, id)
+	}
+	if len(absent) > 0 {
+		rm.holdMessage(room, senderID, absent, msg)
+	}
+
+	if !multi && len(unknown) > 0 && policy == absentError {
+		rm.peerGone(room, senderID, unknown[:1])
+	}
+	if multi && len(unknown) > 0 {
+		if val, ok := room.Peers.Load(senderID); ok {
+			val.(*Peer).SendJSON(map[string]interface{}{
+				"type":      "error",
+				"code":      "UNKNOWN_TARGETS",
+				"message":   "Some targets are not in the room",
+				"targetIds": unknown,
+			})
+		}
+	}
+}
+
+// Policies for a message whose targetId is not in the room, set server-wide
+// by SENDIT_GO_ABSENT_TARGET_POLICY and per message by "onAbsent".
+const (
+	absentDrop  = "drop"  // discard silently
+	absentError = "error" // tell the sender with PEER_GONE
+	absentQueue = "queue" // hold for AbsentTargetHold in case the target reconnects
+)
+
+// Held messages past this many per target push out the oldest. A room
+// holds at most maxHeldPerRoom (one per target), so made-up target IDs
+// can't grow it; past that the sender gets PEER_GONE straight away.
+const (
+	maxHeldPerTarget = 64
+	maxHeldPerRoom   = 256
+)
+
+// maxRelayTargets caps "targetIds" on one message.
+const maxRelayTargets = 64
+
+func validAbsentPolicy(p string) bool {
+	return p == absentDrop || p == absentError || p == absentQueue
+}
+
+// heldMessage is a message waiting for its target to reconnect.
+type heldMessage struct {
+	sender string
+	msg    map[string]interface{}
+}
+
+// holdMessage queues msg for each of targets. Those that haven't
+// reconnected to this instance within AbsentTargetHold are reported to the
+// sender in one PEER_GONE.
+func (rm *RoomManager) holdMessage(room *Room, senderID string, targets []string, msg map[string]interface{}) {
+	h := &heldMessage{sender: senderID, msg: msg}
+	var held, refused, evicted []string
+	var evictedFrom []*heldMessage
+	room.heldMu.Lock()
+	if room.held == nil {
+		room.held = make(map[string][]*heldMessage)
+	}
+	for _, target := range targets {
+		queue := room.held[target]
+		if len(queue) < maxHeldPerTarget && room.heldCount >= maxHeldPerRoom {
+			refused = append(refused, target)
+			continue
+		}
+		queue = append(queue, h)
+		if len(queue) > maxHeldPerTarget {
+			evictedFrom = append(evictedFrom, queue[0])
+			evicted = append(evicted, target)
+			queue = queue[1:]
+		} else {
+			room.heldCount++
+		}
+		room.held[target] = queue
+		held = append(held, target)
+	}
+	room.heldMu.Unlock()
+
+	rm.peerGone(room, senderID, refused)
+	for i, old := range evictedFrom {
+		rm.peerGone(room, old.sender, evicted[i:i+1])
+	}
+	if len(held) == 0 {
+		return
+	}
+	time.AfterFunc(rm.cfg.AbsentTargetHold, func() {
+		var gone []string
+		for _, target := range held {
+			if room.unhold(target, h) {
+				gone = append(gone, target)
+			}
+		}
+		rm.peerGone(room, h.sender, gone)
 	})
 }
 
-func (rm *RoomManager) CheckIPLimit(ip string) bool {
-	val, ok := rm.ipConnections.Load(ip)
+// unhold removes h from target's queue, reporting whether it was still there.
+func (r *Room) unhold(target string, h *heldMessage) bool {
+	r.heldMu.Lock()
+	defer r.heldMu.Unlock()
+	queue := r.held[target]
+	for i, q := range queue {
+		if q == h {
+			queue = append(queue[:i:i], queue[i+1:]...)
+			if len(queue) == 0 {
+				delete(r.held, target)
+			} else {
+				r.held[target] = queue
+			}
+			r.heldCount--
+			return true
+		}
+	}
+	return false
+}
+
+// deliverHeld sends peer the messages held for its ID, in order.
+func (rm *RoomManager) deliverHeld(room *Room, peer *Peer) {
+	room.heldMu.Lock()
+	queue := room.held[peer.ID]
+	delete(room.held, peer.ID)
+	room.heldCount -= len(queue)
+	room.heldMu.Unlock()
+	for _, h := range queue {
+		peer.SendJSON(h.msg)
+	}
+}
+
+// peerGone tells senderID that a message for targets was not delivered.
+// A single target is named in "targetId", several in "targetIds".
+func (rm *RoomManager) peerGone(room *Room, senderID string, targets []string) {
+	if len(targets) == 0 {
+		return
+	}
+	val, ok := room.Peers.Load(senderID)
 	if !ok {
+		return
+	}
+	msg := map[string]interface{}{
+		"type":    "error",
+		"code":    "PEER_GONE",
+		"message": "Target is not in the room",
+	}
+	if len(targets) == 1 {
+		msg["targetId"] = targets[0]
+	} else {
+		msg["message"] = "Targets are not in the room"
+		msg["targetIds"] = targets
+	}
+	val.(*Peer).SendJSON(msg)
+}
+
+// relayTargets returns the explicit recipients of msg, or nil for a
+// broadcast. "targetIds" takes precedence over a single "targetId"; multi
+// reports whether the array form was used. The sender is never a target.
+func relayTargets(msg map[string]interface{}, senderID string) (targets []string, multi bool) {
+	if ids, ok := msg["targetIds"].([]interface{}); ok {
+		seen := make(map[string]bool, len(ids))
+		targets = make([]string, 0, len(ids))
+		for _, v := range ids {
+			id, _ := v.(string)
+			if id == "" || id == senderID || seen[id] {
+				continue
+			}
+			seen[id] = true
+			targets = append(targets, id)
+		}
+		return targets, true
+	}
+	if id, _ := msg["targetId"].(string); id != "" {
+		if id == senderID {
+			return []string{}, false
+		}
+		return []string{id}, false
+	}
+	return nil, false
+}
+
+func (rm *RoomManager) CheckIPLimit(ip string) bool {
+	return rm.ipConns(ip) < int64(rm.cfg.MaxConnsPerIP)
+}
+
+// ipConns counts ip's sockets that hold server resources: joined peers,
+// and those still waiting for their hello or for admission.
+func (rm *RoomManager) ipConns(ip string) int64 {
+	return rm.limits.Count("conn:"+ip) + rm.limits.Count("hello:"+ip) + rm.limits.Count("queued:"+ip)
+}
+
+// AllowMessage counts one inbound message from peerID against
+// MaxMsgPerSecond and reports whether it is within the limit.
+func (rm *RoomManager) AllowMessage(roomCode, peerID string) bool {
+	if rm.cfg.MaxMsgPerSecond <= 0 {
+		return true
+	}
+	return rm.limits.Hit("msg:"+roomCode+":"+peerID, time.Second) <= int64(rm.cfg.MaxMsgPerSecond)
+}
+
+// AllowMessageType counts one msgType message from peerID against its
+// MsgTypeLimits entry. Types without an entry are only subject to
+// AllowMessage, so clients can't mint limiter keys with made-up types.
+func (rm *RoomManager) AllowMessageType(roomCode, peerID, msgType string) (limit int, ok bool) {
+	limit, limited := rm.cfg.MsgTypeLimits[msgType]
+	if !limited {
+		return 0, true
+	}
+	return limit, rm.limits.Hit("msgtype:"+roomCode+":"+peerID+":"+msgType, time.Second) <= int64(limit)
+}
+
+// AllowReconnect counts one join by peerID against ReconnectLimit, so a
+// flapping client can't flood its room with peer-joined/peer-left.
+func (rm *RoomManager) AllowReconnect(roomCode, peerID string) bool {
+	if rm.cfg.ReconnectLimit <= 0 || peerID == "" {
 		return true
 	}
-	return val.(*atomic.Int32).Load() < int32(cfg.MaxConnsPerIP)
+	return rm.limits.Hit("join:"+roomCode+":"+peerID, rm.cfg.ReconnectWindow) <= int64(rm.cfg.ReconnectLimit)
 }
 
 func (rm *RoomManager) CleanupLoop() {
 	ticker := time.NewTicker(time.Minute)
 	defer ticker.Stop()
 	for range ticker.C {
-		count := 0
+		count, idle := 0, 0
 		rm.rooms.Range(func(key, value interface{}) bool {
 			room := value.(*Room)
-			if room.IsExpired() {
+			if !room.IsExpired(rm.cfg.RoomTimeout) && room.IsIdle(rm.cfg.RoomIdleTimeout) {
+				room.Peers.Range(func(_, v interface{}) bool {
+					p := v.(*Peer)
+					p.SendJSON(map[string]interface{}{
+						"type":   "room-closed",
+						"by":     "server",
+						"reason": "idle",
+					})
+					p.flushBatch()
+					p.markDead()
+					return true
+				})
+				rm.deleteRoom(room)
+				idle++
+				return true
+			}
+			if room.IsExpired(rm.cfg.RoomTimeout) {
 				// Close all peer connections
 				room.Peers.Range(func(_, v interface{}) bool {
-					v.(*Peer).Conn.Close()
+					v.(*Peer).markDead()
 					return true
 				})
-				rm.rooms.Delete(key)
+				rm.deleteRoom(room)
 				count++
 			}
 			return true
@@ -348,9 +1914,45 @@ func (rm *RoomManager) CleanupLoop() {
 		if count > 0 {
 			log.Printf("[Cleanup] Removed %d expired rooms", count)
 		}
+		if idle > 0 {
+			log.Printf("[Cleanup] Closed %d idle rooms", idle)
+		}
+		if mem, ok := rm.limits.(*memoryLimitStore); ok {
+			mem.sweep()
+		}
+		rm.tombstones.Range(func(key, _ interface{}) bool {
+			rm.Tombstoned(key.(string))
+			return true
+		})
+	}
+}
+
+// deflateStats reports what permessage-deflate saved on outbound frames.
+// ratio is wire/payload bytes (lower is better; frame headers included).
+func (rm *RoomManager) deflateStats() map[string]interface{} {
+	payload, wire := rm.deflate.payload.Load(), rm.deflate.wire.Load()
+	ratio := 0.0
+	if payload > 0 {
+		ratio = float64(wire) / float64(payload)
+	}
+	return map[string]interface{}{
+		"enabled":      rm.cfg.WSCompression,
+		"payloadBytes": payload,
+		"wireBytes":    wire,
+		"ratio":        ratio,
 	}
 }
 
+// LocalPeerCount counts peers connected to this instance.
+func (rm *RoomManager) LocalPeerCount() int {
+	count := 0
+	rm.rooms.Range(func(_, value interface{}) bool {
+		count += value.(*Room).PeerCount()
+		return true
+	})
+	return count
+}
+
 func (rm *RoomManager) RoomCount() int {
 	count := 0
 	rm.rooms.Range(func(_, _ interface{}) bool {
@@ -365,422 +1967,3483 @@ func (rm *RoomManager) RoomCount() int {
 // ============================================
 
 type FileMeta struct {
-	ID           string  `json:"id"`
-	Name         string  `json:"name"`
-	Size         int64   `json:"size"`
-	OriginalSize int64   `json:"originalSize"`
-	MimeType     string  `json:"mimeType"`
-	Checksum     string  `json:"checksum"`
-	Compressed   bool    `json:"compressed"`
-	RoomCode     string  `json:"roomCode,omitempty"`
-	UploadedAt   float64 `json:"uploadedAt"`
-	ExpiresAt    float64 `json:"expiresAt"`
+	ID           string `json:"id"`
+	Name         string `json:"name"`
+	Size         int64  `json:"size"`
+	OriginalSize int64  `json:"originalSize"`
+	MimeType     string `json:"mimeType"`
+	Checksum     string `json:"checksum"`
+	Compressed   bool   `json:"compressed"`
+	// Ext is the sanitized extension stored files carry with
+	// SENDIT_GO_KEEP_EXTENSIONS, e.g. ".pdf"; empty otherwise
+	Ext string `json:"ext,omitempty"`
+	// CompressReason records why Compressed was chosen: "forced",
+	// "disabled", "auto", "incompressible" or "empty"
+	CompressReason string  `json:"compressReason"`
+	RoomCode       string  `json:"roomCode,omitempty"`
+	UploadedAt     float64 `json:"uploadedAt"`
+	ExpiresAt      float64 `json:"expiresAt"`
+	// Locations lists the primary and mirror backends when mirroring is on
+	Locations []string `json:"locations,omitempty"`
+	// DeleteToken authorizes DELETE before the TTL; given to the uploader
+	// and rotated by adopt-file. Guarded by FileRelay.ownerMu once stored.
+	DeleteToken string `json:"deleteToken"`
 }
 
-type FileRelay struct {
-	uploadDir string
-	files     sync.Map // map[string]*FileMeta
+// expired reports whether the file is past its TTL, even if the cleanup
+// loop has not removed it yet.
+func (m *FileMeta) expired() bool {
+	return m.ExpiresAt > 0 && float64(time.Now().Unix()) > m.ExpiresAt
 }
 
-func NewFileRelay() *FileRelay {
-	os.MkdirAll(cfg.UploadDir, 0755)
-	return &FileRelay{uploadDir: cfg.UploadDir}
+// rangeCacheKey holds a decompressed copy of a compressed file, built on
+// the first Range request so resumed downloads can seek.
+func (m *FileMeta) rangeCacheKey() string {
+	return m.ID + ".raw"
 }
 
-func generateFileID() string {
-	b := make([]byte, 12)
-	rand.Read(b)
-	return hex.EncodeToString(b)
+// storageKey is the object the file's bytes are stored under.
+func (m *FileMeta) storageKey() string {
+	if m.Compressed {
+		return m.ID + m.Ext + ".lz4"
+	}
+	return m.ID + m.Ext
 }
 
-func (fr *FileRelay) Upload(w http.ResponseWriter, r *http.Request) {
-	r.Body = http.MaxBytesReader(w, r.Body, cfg.MaxFileSize)
+const maxStoredExtLength = 10
 
-	file, header, err := r.FormFile("file")
-	if err != nil {
-		http.Error(w, "Failed to read file", http.StatusBadRequest)
-		return
+// reservedExts are suffixes the relay itself uses for sidecars, caches and
+// in-progress writes; a file named like one keeps its bare ID.
+var reservedExts = map[string]bool{"meta": true, "raw": true, "tmp": true, "lz4": true}
+
+// storedExt derives a safe on-disk extension from an uploaded file name:
+// lowercase alphanumerics only, or "" when there is nothing usable.
+func storedExt(name string) string {
+	i := strings.LastIndexAny(name, `./\`)
+	if i < 0 || name[i] != '.' || len(name)-i-1 > maxStoredExtLength {
+		return ""
 	}
-	defer file.Close()
+	ext := strings.ToLower(name[i+1:])
+	if ext == "" || reservedExts[ext] {
+		return ""
+	}
+	for j := 0; j < len(ext); j++ {
+		if c := ext[j]; !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9') {
+			return ""
+		}
+	}
+	return "." + ext
+}
 
-	fileID := generateFileID()
-	roomCode := r.URL.Query().Get("room_code")
-	compress := r.URL.Query().Get("compress") != "false"
+// metaKey is the sidecar object holding the JSON-encoded FileMeta, so any
+// instance sharing the storage backend can serve the download.
+func metaKey(fileID string) string {
+	return fileID + ".meta"
+}
 
-	var storedPath string
-	var storedSize int64
-	var originalSize int64
-	isCompressed := false
+// uploadTicket is a single-use token binding an upload to a room, handed out
+// over signaling when peers fall back from P2P to the relay.
+type uploadTicket struct {
+	Token     string
+	RoomCode  string
+	ExpiresAt time.Time
+}
 
-	if compress {
-		// LZ4 compressed storage
-		storedPath = filepath.Join(fr.uploadDir, fileID+".lz4")
-		outFile, err := os.Create(storedPath)
+const uploadTicketTTL = 10 * time.Minute
+
+type FileRelay struct {
+	cfg       *Config
+	tickets   sync.Map // map[string]*uploadTicket
+	rooms     *RoomManager
+	bufs      *bufferPool
+	storage   Storage
+	files     sync.Map // map[string]*FileMeta
+	fileCount atomic.Int64
+	rangeMu   sync.Map  // map[fileID]*sync.Mutex, guards building a range cache
+	breaker   *breaker  // trips on repeated storage write failures
+	audit     *auditLog // nil unless SENDIT_GO_AUDIT_LOG is set
+
+	// In-flight uploads, waited on at shutdown. uploadMu orders Add against
+	// DrainUploads so no upload starts once the wait has begun.
+	uploadMu sync.RWMutex
+	uploads  sync.WaitGroup
+	draining bool
+
+	downloadsMu sync.Mutex
+	downloads   map[string]int // active downloads per file ID, with MaxDownloadsPerFile
+
+	ownerMu sync.Mutex // guards FileMeta.DeleteToken
+
+	chunkPools []*bufferPool // power-of-two buffers from minDownloadChunk, for ?chunkSize=
+}
+
+// Bounds for a client-chosen download chunk size
+const (
+	minDownloadChunk = 4 * 1024
+	maxDownloadChunk = 4 * 1024 * 1024
+)
+
+// downloadBuffer returns a copy buffer for ?chunkSize=, or the ChunkSize
+// buffer when the client didn't ask. Requests are clamped to the download
+// chunk bounds and served from the smallest pooled size that fits, so odd
+// sizes don't each get a pool of their own. put returns the buffer.
+func (fr *FileRelay) downloadBuffer(r *http.Request) (buf []byte, put func(), err error) {
+	v := r.URL.Query().Get("chunkSize")
+	if v == "" {
+		b := fr.bufs.get()
+		return *b, func() { fr.bufs.put(b) }, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n <= 0 {
+		return nil, nil, fmt.Errorf("chunkSize must be a positive integer (clamped to %d-%d)", minDownloadChunk, maxDownloadChunk)
+	}
+	n = min(max(n, minDownloadChunk), maxDownloadChunk)
+	i := 0
+	for minDownloadChunk<<i < n {
+		i++
+	}
+	pool := fr.chunkPools[i]
+	b := pool.get()
+	return (*b)[:n], func() { pool.put(b) }, nil
+}
+
+// beginUpload registers an upload, or reports false once draining. Callers
+// must call fr.uploads.Done when it returns true.
+func (fr *FileRelay) beginUpload() bool {
+	fr.uploadMu.RLock()
+	defer fr.uploadMu.RUnlock()
+	if fr.draining {
+		return false
+	}
+	fr.uploads.Add(1)
+	return true
+}
+
+// DrainUploads refuses new uploads and waits up to grace for in-flight
+// ones, so a deploy doesn't cut large transfers off halfway.
+func (fr *FileRelay) DrainUploads(grace time.Duration) {
+	fr.uploadMu.Lock()
+	fr.draining = true
+	fr.uploadMu.Unlock()
+	if grace <= 0 {
+		return
+	}
+
+	done := make(chan struct{})
+	go func() {
+		fr.uploads.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(grace):
+		log.Printf("[Drain] Upload grace of %s ran out with uploads in flight", grace)
+	}
+}
+
+func NewFileRelay(cfg *Config, rooms *RoomManager) (*FileRelay, error) {
+	bufs := newBufferPool(cfg.ChunkSize)
+	storage, err := NewStorage(cfg, bufs)
+	if err != nil {
+		return nil, fmt.Errorf("storage init: %w", err)
+	}
+	audit, err := newAuditLog(cfg.AuditLog)
+	if err != nil {
+		return nil, fmt.Errorf("audit log init: %w", err)
+	}
+	var chunkPools []*bufferPool
+	for size := minDownloadChunk; size <= maxDownloadChunk; size <<= 1 {
+		chunkPools = append(chunkPools, newBufferPool(size))
+	}
+	return &FileRelay{
+		cfg:       cfg,
+		rooms:     rooms,
+		bufs:      bufs,
+		storage:   storage,
+		breaker:   newBreaker(cfg.BreakerThreshold, cfg.BreakerCooldown),
+		audit:     audit,
+		downloads: make(map[string]int),
+
+		chunkPools: chunkPools,
+	}, nil
+}
+
+// IssueTicket allocates an upload ticket scoped to roomCode.
+func (fr *FileRelay) IssueTicket(roomCode string) *uploadTicket {
+	t := &uploadTicket{
+		Token:     generateFileID(),
+		RoomCode:  roomCode,
+		ExpiresAt: time.Now().Add(uploadTicketTTL),
+	}
+	fr.tickets.Store(t.Token, t)
+	return t
+}
+
+// TicketFor returns the ticket token names if it is still unredeemed and
+// unexpired, or issues a new one for roomCode. A peer that keeps sending
+// request-relay then holds one live ticket rather than one per message.
+func (fr *FileRelay) TicketFor(token, roomCode string) *uploadTicket {
+	if val, ok := fr.tickets.Load(token); ok {
+		if t := val.(*uploadTicket); time.Now().Before(t.ExpiresAt) {
+			return t
+		}
+	}
+	return fr.IssueTicket(roomCode)
+}
+
+// redeemTicket claims token for one upload, returning its ticket if it was
+// still valid. Nobody else can redeem it until the upload hands it back
+// with releaseTicket or succeeds, which consumes it.
+func (fr *FileRelay) redeemTicket(token string) (*uploadTicket, bool) {
+	val, ok := fr.tickets.LoadAndDelete(token)
+	if !ok {
+		return nil, false
+	}
+	t := val.(*uploadTicket)
+	return t, time.Now().Before(t.ExpiresAt)
+}
+
+// releaseTicket puts back a ticket whose upload failed, so the client can
+// retry with the same token instead of needing a new one.
+func (fr *FileRelay) releaseTicket(t *uploadTicket) {
+	fr.tickets.Store(t.Token, t)
+}
+
+func generateFileID() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// uploadError carries the HTTP status and message for a failed store.
+type uploadError struct {
+	status int
+	msg    string
+	detail map[string]interface{} // sent as a JSON body when set
+}
+
+func (e *uploadError) Error() string { return e.msg }
+
+func (e *uploadError) write(w http.ResponseWriter) {
+	if e.detail == nil {
+		http.Error(w, e.msg, e.status)
+		return
+	}
+	e.detail["error"] = e.msg
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(e.status)
+	json.NewEncoder(w).Encode(e.detail)
+}
+
+func (fr *FileRelay) Upload(w http.ResponseWriter, r *http.Request) {
+	if !fr.beginUpload() {
+		http.Error(w, "Server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	defer fr.uploads.Done()
+	if !fr.limitBody(w, r) {
+		return
+	}
+	if fr.cfg.UploadSlowStart > 0 {
+		r.Body = newSlowStartBody(r.Context(), r.Body, fr.cfg.UploadSlowStartRate, fr.cfg.UploadSlowStart)
+	}
+
+	file, err := nextFilePart(r)
+	if err != nil {
+		http.Error(w, "Failed to read file", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	meta, err := fr.store(file, file.FileName(), file.Header.Get("Content-Type"), r)
+	if err != nil {
+		err.(*uploadError).write(w)
+		return
+	}
+	writeUploadResponse(w, r, fr.cfg, meta)
+}
+
+// limitBody caps r.Body at MaxFileSize. A declared Content-Length over the
+// cap is refused with 413 before any of the body is read (a client sending
+// Expect: 100-continue never transmits it); MaxBytesReader still catches
+// chunked bodies that run over.
+func (fr *FileRelay) limitBody(w http.ResponseWriter, r *http.Request) bool {
+	if r.ContentLength > fr.cfg.MaxFileSize {
+		fr.tooLarge(&http.MaxBytesError{Limit: fr.cfg.MaxFileSize}).write(w)
+		return false
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, fr.cfg.MaxFileSize)
+	return true
+}
+
+// tooLarge turns a body that tripped MaxBytesReader into a 413.
+func (fr *FileRelay) tooLarge(err error) *uploadError {
+	var mbe *http.MaxBytesError
+	if !errors.As(err, &mbe) {
+		return nil
+	}
+	return &uploadError{http.StatusRequestEntityTooLarge, fmt.Sprintf("File too large (max %d bytes)", fr.cfg.MaxFileSize), nil}
+}
+
+const (
+	maxFormFields    = 32
+	maxFormFieldSize = 64 * 1024
+)
+
+// nextFilePart walks a multipart upload up to its "file" part and returns
+// that part unread, so the body streams straight into storage instead of
+// being spooled by ParseMultipartForm first. Plain fields sent before the
+// file (room_code, compress, checksum, token...) are folded into the query
+// string, which wins on conflict; fields after the file are never read.
+func nextFilePart(r *http.Request) (*multipart.Part, error) {
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+	query := r.URL.Query()
+	for fields := 0; ; {
+		part, err := mr.NextPart()
 		if err != nil {
-			http.Error(w, "Storage error", http.StatusInternalServerError)
-			return
+			return nil, err
+		}
+		if part.FormName() == "file" && part.FileName() != "" {
+			r.URL.RawQuery = query.Encode()
+			return part, nil
+		}
+		if fields++; fields > maxFormFields {
+			return nil, errors.New("too many form fields")
+		}
+		value, err := io.ReadAll(io.LimitReader(part, maxFormFieldSize))
+		part.Close()
+		if err != nil {
+			return nil, err
+		}
+		if name := part.FormName(); name != "" && part.FileName() == "" && !query.Has(name) {
+			query.Set(name, string(value))
 		}
+	}
+}
 
-		lz4Writer := lz4.NewWriter(outFile)
-		lz4Writer.Apply(lz4.CompressionLevelOption(lz4.Level4))
+// UploadRaw handles PUT /api/relay/upload/raw?name=...&mime=..., streaming
+// the request body straight into storage without multipart framing.
+func (fr *FileRelay) UploadRaw(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !fr.beginUpload() {
+		http.Error(w, "Server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	defer fr.uploads.Done()
+	if !fr.limitBody(w, r) {
+		return
+	}
+	if fr.cfg.UploadSlowStart > 0 {
+		r.Body = newSlowStartBody(r.Context(), r.Body, fr.cfg.UploadSlowStartRate, fr.cfg.UploadSlowStart)
+	}
+	defer r.Body.Close()
 
-		buf := getBuffer()
-		defer putBuffer(buf)
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		name = "upload.bin"
+	}
+	mimeType := r.URL.Query().Get("mime")
+	if mimeType == "" {
+		mimeType = r.Header.Get("Content-Type")
+	}
 
-		for {
-			n, err := file.Read(*buf)
-			if n > 0 {
-				originalSize += int64(n)
-				lz4Writer.Write((*buf)[:n])
-			}
-			if err == io.EOF {
-				break
-			}
-			if err != nil {
-				outFile.Close()
-				os.Remove(storedPath)
-				http.Error(w, "Read error", http.StatusInternalServerError)
-				return
+	meta, err := fr.store(r.Body, name, mimeType, r)
+	if err != nil {
+		err.(*uploadError).write(w)
+		return
+	}
+	writeUploadResponse(w, r, fr.cfg, meta)
+}
+
+// store writes src to the upload dir (LZ4-compressed unless ?compress=false)
+// and registers its FileMeta.
+func (fr *FileRelay) store(src io.Reader, name, mimeType string, r *http.Request) (*FileMeta, error) {
+	if !fr.breaker.Allow() {
+		return nil, &uploadError{http.StatusServiceUnavailable, "Storage temporarily unavailable", nil}
+	}
+	if !fr.reserveFileSlot() {
+		return nil, &uploadError{http.StatusInsufficientStorage, "Too many stored files", nil}
+	}
+	stored := false
+	defer func() {
+		if !stored {
+			fr.fileCount.Add(-1)
+		}
+	}()
+
+	fileID := generateFileID()
+	ext := ""
+	if fr.cfg.KeepExtensions {
+		ext = storedExt(name)
+	}
+	key := fileID + ext
+	// Normalized like every other room code, so Adopt and keepRoomAlive
+	// can match it against the live room
+	roomCode := r.URL.Query().Get("room_code")
+	if roomCode != "" {
+		var ok bool
+		if roomCode, ok = fr.rooms.NormalizeCode(roomCode); !ok {
+			return nil, &uploadError{http.StatusBadRequest, "Invalid room code", nil}
+		}
+	}
+	if token := r.URL.Query().Get("token"); token != "" {
+		ticket, ok := fr.redeemTicket(token)
+		if !ok {
+			return nil, &uploadError{http.StatusForbidden, "Invalid or expired upload token", nil}
+		}
+		roomCode = ticket.RoomCode
+		defer func() {
+			if !stored {
+				fr.releaseTicket(ticket)
 			}
+		}()
+	}
+	defer fr.keepRoomAlive(roomCode)()
+
+	// Hash what the client sent, so ?checksum=<sha256 hex> can be verified
+	// before the file becomes downloadable
+	hasher := sha256.New()
+	client := &errReader{r: src}
+	src = io.TeeReader(client, hasher)
+
+	// Sniff the leading bytes so already-compressed media skips LZ4
+	head := make([]byte, 512)
+	n, err := io.ReadFull(src, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, &uploadError{http.StatusInternalServerError, "Read error", nil}
+	}
+	head = head[:n]
+	src = io.MultiReader(bytes.NewReader(head), src)
+
+	var compress bool
+	var reason string
+	switch mode := r.URL.Query().Get("compress"); {
+	case len(head) == 0:
+		// A zero-byte upload is stored as an empty file; even an empty LZ4
+		// frame would be larger
+		compress, reason = false, "empty"
+	case mode == "true":
+		compress, reason = true, "forced"
+	case mode == "false":
+		compress, reason = false, "disabled"
+	default:
+		if fr.incompressible(http.DetectContentType(head), mimeType) {
+			compress, reason = false, "incompressible"
+		} else {
+			compress, reason = true, "auto"
 		}
+	}
+
+	var storedSize int64
+	var originalSize int64
+	isCompressed := false
 
-		lz4Writer.Close()
-		outFile.Close()
+	if compress {
+		// LZ4 compressed storage, streamed into the backend through a pipe
+		pr, pw := io.Pipe()
+		compErr := make(chan error, 1)
+		go func() {
+			n, err := fr.compress(pw, src)
+			originalSize = n
+			// A failed compressor must fail Put too, never hand it a
+			// truncated stream that looks like a clean EOF.
+			pw.CloseWithError(err)
+			compErr <- err
+		}()
 
-		info, _ := os.Stat(storedPath)
-		storedSize = info.Size()
+		written, err := fr.storage.Put(key+".lz4", pr)
+		pr.CloseWithError(io.ErrClosedPipe) // unblock the compressor if Put bailed early
+		if cerr := <-compErr; cerr != nil || err != nil {
+			fr.storage.Delete(key + ".lz4")
+			if cerr != nil && err == nil {
+				err = cerr
+			}
+			if client.err == nil {
+				fr.breaker.Failure()
+			}
+			log.Printf("[Relay] Compressed upload %s failed: %v", fileID, err)
+			if ue := fr.tooLarge(client.err); ue != nil {
+				return nil, ue
+			}
+			return nil, &uploadError{http.StatusInternalServerError, "Compression error", nil}
+		}
+		storedSize = written
 		isCompressed = true
 	} else {
 		// Raw storage
-		storedPath = filepath.Join(fr.uploadDir, fileID)
-		outFile, err := os.Create(storedPath)
-		if err != nil {
-			http.Error(w, "Storage error", http.StatusInternalServerError)
-			return
-		}
-
-		buf := getBuffer()
-		defer putBuffer(buf)
-
-		written, err := io.CopyBuffer(outFile, file, *buf)
-		outFile.Close()
+		written, err := fr.storage.Put(key, src)
 		if err != nil {
-			os.Remove(storedPath)
-			http.Error(w, "Write error", http.StatusInternalServerError)
-			return
+			// Backends discard partial writes themselves; delete anyway so
+			// no backend can leave a truncated file behind
+			fr.storage.Delete(key)
+			if client.err == nil {
+				fr.breaker.Failure()
+			}
+			log.Printf("[Relay] Upload %s failed: %v", fileID, err)
+			if ue := fr.tooLarge(client.err); ue != nil {
+				return nil, ue
+			}
+			return nil, &uploadError{http.StatusInternalServerError, "Write error", nil}
 		}
 		originalSize = written
 		storedSize = written
 	}
 
+	fr.breaker.Success()
+
+	checksum := hex.EncodeToString(hasher.Sum(nil))
+	if want := r.URL.Query().Get("checksum"); want != "" && !strings.EqualFold(want, checksum) {
+		fr.storage.Delete(key)
+		fr.storage.Delete(key + ".lz4")
+		return nil, &uploadError{http.StatusBadRequest, "Checksum mismatch", nil}
+	}
+	// ?expectedSha256= is the stricter form: a mismatch reports both hashes
+	// with a 422, so the client can tell corruption from a bad request
+	if want := r.URL.Query().Get("expectedSha256"); want != "" && !strings.EqualFold(want, checksum) {
+		fr.storage.Delete(key)
+		fr.storage.Delete(key + ".lz4")
+		return nil, &uploadError{http.StatusUnprocessableEntity, "Checksum mismatch", map[string]interface{}{
+			"expected": strings.ToLower(want),
+			"actual":   checksum,
+		}}
+	}
+
 	meta := &FileMeta{
-		ID:           fileID,
-		Name:         header.Filename,
-		Size:         storedSize,
-		OriginalSize: originalSize,
-		MimeType:     header.Header.Get("Content-Type"),
-		Compressed:   isCompressed,
-		RoomCode:     roomCode,
-		UploadedAt:   float64(time.Now().Unix()),
-		ExpiresAt:    float64(time.Now().Add(cfg.RelayFileTTL).Unix()),
+		ID:             fileID,
+		Name:           name,
+		Size:           storedSize,
+		OriginalSize:   originalSize,
+		MimeType:       mimeType,
+		Checksum:       checksum,
+		Compressed:     isCompressed,
+		Ext:            ext,
+		CompressReason: reason,
+		RoomCode:       roomCode,
+		Locations:      storageLocations(fr.storage),
+		UploadedAt:     float64(time.Now().Unix()),
+		ExpiresAt:      float64(time.Now().Add(fr.cfg.RelayFileTTL).Unix()),
+		DeleteToken:    generateFileID(),
 	}
 
+	fr.saveMeta(meta)
 	fr.files.Store(fileID, meta)
+	stored = true
+	fr.rooms.totalBytesRelay.Add(originalSize)
+	return meta, nil
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"fileId":         meta.ID,
-		"name":           meta.Name,
-		"size":           meta.OriginalSize,
-		"compressed":     meta.Compressed,
-		"compressedSize": meta.Size,
-		"downloadUrl":    fmt.Sprintf("/api/relay/download/%s", meta.ID),
-		"expiresAt":      meta.ExpiresAt,
+// compress LZ4-encodes src into dst and returns the uncompressed byte
+// count. Every Write and the final Close are checked, since a dropped
+// error leaves a frame that only fails later, at download time.
+func (fr *FileRelay) compress(dst io.Writer, src io.Reader) (int64, error) {
+	lz4Writer := lz4.NewWriter(dst)
+	if err := lz4Writer.Apply(lz4.CompressionLevelOption(lz4.Level4)); err != nil {
+		return 0, err
+	}
+
+	buf := fr.bufs.get()
+	defer fr.bufs.put(buf)
+
+	var total int64
+	for {
+		n, err := src.Read(*buf)
+		if n > 0 {
+			total += int64(n)
+			if _, werr := lz4Writer.Write((*buf)[:n]); werr != nil {
+				return total, werr
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// Leave the frame unterminated: Close would write a valid end
+			// mark and make the truncated stream look complete
+			return total, err
+		}
+	}
+	return total, lz4Writer.Close()
+}
+
+// incompressible reports whether the sniffed type (or the client-declared
+// one, when sniffing is inconclusive) is in IncompressibleTypes.
+func (fr *FileRelay) incompressible(sniffed, declared string) bool {
+	mimeType := sniffed
+	if mimeType == "application/octet-stream" && declared != "" {
+		mimeType = declared
+	}
+	mimeType = strings.ToLower(strings.TrimSpace(strings.SplitN(mimeType, ";", 2)[0]))
+	for _, t := range fr.cfg.IncompressibleTypes {
+		if strings.HasSuffix(t, "/") && strings.HasPrefix(mimeType, t) || mimeType == t {
+			return true
+		}
+	}
+	return false
+}
+
+// reserveFileSlot counts one more stored file against MaxFiles, evicting
+// the soonest-to-expire file first when EvictOnFull is set.
+func (fr *FileRelay) reserveFileSlot() bool {
+	if fr.cfg.MaxFiles <= 0 {
+		fr.fileCount.Add(1)
+		return true
+	}
+	if fr.fileCount.Add(1) <= int64(fr.cfg.MaxFiles) {
+		return true
+	}
+	if fr.cfg.EvictOnFull && fr.evictSoonest() {
+		return true
+	}
+	fr.fileCount.Add(-1)
+	return false
+}
+
+func (fr *FileRelay) evictSoonest() bool {
+	var victim *FileMeta
+	fr.files.Range(func(_, value interface{}) bool {
+		meta := value.(*FileMeta)
+		if victim == nil || meta.ExpiresAt < victim.ExpiresAt {
+			victim = meta
+		}
+		return true
 	})
+	return victim != nil && fr.removeFile(victim)
 }
 
-func (fr *FileRelay) Download(w http.ResponseWriter, r *http.Request) {
-	fileID := strings.TrimPrefix(r.URL.Path, "/api/relay/download/")
-	
-	val, ok := fr.files.Load(fileID)
+// saveMeta writes meta's storage sidecar, which lookup falls back to on
+// instances that didn't take the upload.
+func (fr *FileRelay) saveMeta(meta *FileMeta) {
+	fr.ownerMu.Lock()
+	data, err := json.Marshal(meta)
+	fr.ownerMu.Unlock()
+	if err == nil {
+		fr.storage.Put(metaKey(meta.ID), bytes.NewReader(data))
+	}
+}
+
+// removeFile forgets meta and deletes its stored objects. It reports false
+// if another caller already removed it.
+func (fr *FileRelay) removeFile(meta *FileMeta) bool {
+	if _, ok := fr.files.LoadAndDelete(meta.ID); !ok {
+		return false
+	}
+	fr.fileCount.Add(-1)
+	fr.deleteObjects(meta)
+	return true
+}
+
+// deleteObjects deletes meta's file, sidecar and range cache.
+func (fr *FileRelay) deleteObjects(meta *FileMeta) {
+	fr.storage.Delete(meta.storageKey())
+	fr.storage.Delete(metaKey(meta.ID))
+	if meta.Compressed {
+		fr.storage.Delete(meta.rangeCacheKey())
+		fr.rangeMu.Delete(meta.ID)
+	}
+}
+
+// Adopt hands the delete token for fileID to a peer in roomCode, for when
+// the uploader has left. The token is rotated, so only the adopter holds
+// a working one.
+func (fr *FileRelay) Adopt(fileID, roomCode string) (string, error) {
+	if !validFileID(fileID) {
+		return "", errors.New("fileId is required")
+	}
+	meta, ok := fr.lookup(fileID)
+	if !ok {
+		return "", errors.New("file not found")
+	}
+	if meta.RoomCode == "" || meta.RoomCode != roomCode {
+		return "", errors.New("file does not belong to this room")
+	}
+	token := generateFileID()
+	fr.ownerMu.Lock()
+	meta.DeleteToken = token
+	fr.ownerMu.Unlock()
+	fr.saveMeta(meta)
+	return token, nil
+}
+
+// Delete serves DELETE /api/relay/download/{id}?deleteToken=..., removing
+// a file before its TTL.
+func (fr *FileRelay) Delete(w http.ResponseWriter, r *http.Request, fileID string) {
+	meta, ok := fr.lookup(fileID)
 	if !ok {
 		http.Error(w, "File not found", http.StatusNotFound)
 		return
 	}
-	meta := val.(*FileMeta)
+	given := r.URL.Query().Get("deleteToken")
+	fr.ownerMu.Lock()
+	valid := given != "" && subtle.ConstantTimeCompare([]byte(given), []byte(meta.DeleteToken)) == 1
+	fr.ownerMu.Unlock()
+	if !valid {
+		http.Error(w, "Invalid delete token", http.StatusForbidden)
+		return
+	}
+	if !fr.removeFile(meta) {
+		// Uploaded through another instance; only the objects are here
+		fr.deleteObjects(meta)
+	}
+	log.Printf("[Relay] Deleted %s before expiry", fileID)
+	w.WriteHeader(http.StatusNoContent)
+}
 
-	var filePath string
-	if meta.Compressed {
-		filePath = filepath.Join(fr.uploadDir, fileID+".lz4")
-	} else {
-		filePath = filepath.Join(fr.uploadDir, fileID)
+// lookup returns the FileMeta for fileID, falling back to the storage
+// sidecar when the upload landed on another instance.
+func (fr *FileRelay) lookup(fileID string) (*FileMeta, bool) {
+	if val, ok := fr.files.Load(fileID); ok {
+		meta := val.(*FileMeta)
+		return meta, !meta.expired()
 	}
 
-	file, err := os.Open(filePath)
+	rc, err := fr.storage.Get(metaKey(fileID))
 	if err != nil {
-		http.Error(w, "File not found", http.StatusNotFound)
-		return
+		return nil, false
 	}
-	defer file.Close()
+	defer rc.Close()
 
-	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, meta.Name))
-	w.Header().Set("X-Original-Size", strconv.FormatInt(meta.OriginalSize, 10))
-	w.Header().Set("X-Compressed", strconv.FormatBool(meta.Compressed))
+	var meta FileMeta
+	if err := json.NewDecoder(io.LimitReader(rc, 64*1024)).Decode(&meta); err != nil || meta.ID != fileID {
+		return nil, false
+	}
+	if meta.expired() {
+		return nil, false
+	}
+	return &meta, true
+}
 
-	decompress := r.URL.Query().Get("decompress") != "false"
+// downloadURL is the absolute link to meta, signed when DownloadSecret is
+// set. A signed link expires after DownloadURLTTL, or with the file.
+func (c *Config) downloadURL(r *http.Request, meta *FileMeta) string {
+	u := fmt.Sprintf("%s/api/relay/download/%s", c.BaseURL(r), meta.ID)
+	if len(c.DownloadSecret) == 0 {
+		return u
+	}
+	exp := time.Now().Add(c.DownloadURLTTL).Unix()
+	if meta.ExpiresAt > 0 && int64(meta.ExpiresAt) < exp {
+		exp = int64(meta.ExpiresAt)
+	}
+	return fmt.Sprintf("%s?exp=%d&sig=%s", u, exp, c.signDownload(meta.ID, exp))
+}
 
-	if meta.Compressed && decompress {
-		lz4Reader := lz4.NewReader(file)
-		buf := getBuffer()
-		defer putBuffer(buf)
-		io.CopyBuffer(w, lz4Reader, *buf)
-	} else {
-		buf := getBuffer()
-		defer putBuffer(buf)
-		io.CopyBuffer(w, file, *buf)
+// signDownload is base64url(HMAC-SHA256(DownloadSecret, subject + "\n" +
+// exp)). subject is the file ID, or the comma-joined ids of a zip download.
+func (c *Config) signDownload(subject string, exp int64) string {
+	mac := hmac.New(sha256.New, c.DownloadSecret)
+	mac.Write([]byte(subject + "\n" + strconv.FormatInt(exp, 10)))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// checkDownloadSig enforces signed URLs when DownloadSecret is set,
+// writing a 403 and returning false for a missing, expired or bad sig.
+func (c *Config) checkDownloadSig(w http.ResponseWriter, r *http.Request, subject string) bool {
+	if len(c.DownloadSecret) == 0 {
+		return true
+	}
+	exp, err := strconv.ParseInt(r.URL.Query().Get("exp"), 10, 64)
+	if err != nil {
+		http.Error(w, "Signed URL required", http.StatusForbidden)
+		return false
+	}
+	if time.Now().Unix() > exp {
+		http.Error(w, "Download link expired", http.StatusForbidden)
+		return false
 	}
+	want := c.signDownload(subject, exp)
+	if !hmac.Equal([]byte(want), []byte(r.URL.Query().Get("sig"))) {
+		http.Error(w, "Invalid download signature", http.StatusForbidden)
+		return false
+	}
+	return true
 }
 
-func (fr *FileRelay) CleanupLoop() {
-	ticker := time.NewTicker(5 * time.Minute)
-	defer ticker.Stop()
-	for range ticker.C {
-		now := float64(time.Now().Unix())
-		count := 0
-		fr.files.Range(func(key, value interface{}) bool {
-			meta := value.(*FileMeta)
-			if meta.ExpiresAt > 0 && now > meta.ExpiresAt {
-				fr.files.Delete(key)
-				fid := key.(string)
-				os.Remove(filepath.Join(fr.uploadDir, fid))
-				os.Remove(filepath.Join(fr.uploadDir, fid+".lz4"))
-				count++
-			}
-			return true
+func writeUploadResponse(w http.ResponseWriter, r *http.Request, cfg *Config, meta *FileMeta) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"fileId":         meta.ID,
+		"name":           meta.Name,
+		"size":           meta.OriginalSize,
+		"compressed":     meta.Compressed,
+		"compressedSize": meta.Size,
+		"checksum":       meta.Checksum,
+		"downloadUrl":    cfg.downloadURL(r, meta),
+		"expiresAt":      meta.ExpiresAt,
+		"deleteToken":    meta.DeleteToken,
+	})
+}
+
+// ctxReader fails reads once ctx is done.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *ctxReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
+
+const maxDownloadPathLength = 256
+
+// validFileID reports whether id has the generateFileID shape: 24 lowercase
+// hex characters. Anything else never reaches storage.
+func validFileID(id string) bool {
+	if len(id) != 24 {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		c := id[i]
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+func (fr *FileRelay) Download(w http.ResponseWriter, r *http.Request) {
+	if len(r.URL.Path) > maxDownloadPathLength {
+		http.Error(w, "Path too long", http.StatusRequestURITooLong)
+		return
+	}
+	fileID, sub, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/relay/download/"), "/")
+	if !validFileID(fileID) {
+		http.Error(w, "Invalid file ID", http.StatusBadRequest)
+		return
+	}
+	if r.Method == http.MethodDelete && sub == "" {
+		fr.Delete(w, r, fileID)
+		return
+	}
+	if !fr.cfg.checkDownloadSig(w, r, fileID) {
+		return
+	}
+
+	meta, ok := fr.lookup(fileID)
+	if !ok {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+
+	w = fr.watchdog(w)
+	if !fr.acquireDownload(fileID) {
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "Too many concurrent downloads of this file", http.StatusTooManyRequests)
+		return
+	}
+	defer fr.releaseDownload(fileID)
+	defer fr.keepRoomAlive(meta.RoomCode)()
+
+	switch sub {
+	case "":
+	case "chunk":
+		fr.DownloadChunk(w, r, meta)
+		return
+	default:
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	buf, putBuf, err := fr.downloadBuffer(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer putBuf()
+
+	file, err := fr.storage.Get(meta.storageKey())
+	if err != nil {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	defer file.Close()
+
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, meta.Name))
+	w.Header().Set("X-Original-Size", strconv.FormatInt(meta.OriginalSize, 10))
+	w.Header().Set("X-Compressed", strconv.FormatBool(meta.Compressed))
+	for name, value := range fr.cfg.DownloadHeaders {
+		w.Header().Set(name, value)
+	}
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+
+	decompress := r.URL.Query().Get("decompress") != "false"
+
+	if r.Header.Get("Range") != "" && fr.serveRange(w, r, meta, file, decompress) {
+		return
+	}
+
+	// Stop reading as soon as the client goes away instead of draining the
+	// file into a dead connection
+	var src io.Reader = &ctxReader{ctx: r.Context(), r: file}
+	size := meta.Size
+	if meta.Compressed && decompress {
+		src = &ctxReader{ctx: r.Context(), r: lz4.NewReader(file)}
+		size = meta.OriginalSize
+	}
+	// Both sizes are recorded at upload, so clients get a real progress
+	// bar even when the body is decompressed on the fly
+	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	if size == 0 {
+		// Nothing to sniff a Content-Type from; use what the uploader sent
+		contentType := meta.MimeType
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		w.Header().Set("Content-Type", contentType)
+		fr.audit.Record(r, meta.ID, 0)
+		return
+	}
+	if rate := fr.downloadRate(r); rate > 0 {
+		src = newRateLimitedReader(r.Context(), src, rate)
+	}
+
+	n, _ := io.CopyBuffer(w, src, buf)
+	fr.rooms.totalBytesRelay.Add(n)
+	fr.audit.Record(r, meta.ID, n)
+}
+
+// watchdog bounds how long a download can hold its connection, since the
+// server has no global WriteTimeout. Each write may block for at most
+// DownloadStall, so a client that stops reading is dropped while
+// one that is slow but still reading keeps going; DownloadMaxDuration caps
+// the whole response regardless.
+func (fr *FileRelay) watchdog(w http.ResponseWriter) http.ResponseWriter {
+	if fr.cfg.DownloadStall <= 0 && fr.cfg.DownloadMaxDuration <= 0 {
+		return w
+	}
+	sw := &stallWriter{ResponseWriter: w, rc: http.NewResponseController(w), stall: fr.cfg.DownloadStall}
+	if fr.cfg.DownloadMaxDuration > 0 {
+		sw.stop = time.Now().Add(fr.cfg.DownloadMaxDuration)
+	}
+	return sw
+}
+
+type stallWriter struct {
+	http.ResponseWriter
+	rc     *http.ResponseController
+	stall  time.Duration
+	stop   time.Time // zero = no overall cap
+	failed bool      // deadlines unsupported by a wrapping writer, logged once
+}
+
+func (sw *stallWriter) Write(p []byte) (int, error) {
+	if sw.failed {
+		return sw.ResponseWriter.Write(p)
+	}
+	deadline := sw.stop
+	if sw.stall > 0 {
+		if next := time.Now().Add(sw.stall); deadline.IsZero() || next.Before(deadline) {
+			deadline = next
+		}
+	}
+	if err := sw.rc.SetWriteDeadline(deadline); err != nil {
+		// A middleware writer without Unwrap hides the connection
+		log.Printf("[Relay] Download watchdog disabled: %v", err)
+		sw.failed = true
+	}
+	return sw.ResponseWriter.Write(p)
+}
+
+func (sw *stallWriter) Unwrap() http.ResponseWriter { return sw.ResponseWriter }
+
+// keepRoomAlive counts a relay transfer for roomCode as room activity
+// until the returned stop is called. Transfers run over HTTP, so without
+// this a long one could outlive RoomTimeout or RoomIdleTimeout and lose
+// its signaling room midway.
+func (fr *FileRelay) keepRoomAlive(roomCode string) (stop func()) {
+	if !fr.cfg.RelayKeepsRoom || roomCode == "" {
+		return func() {}
+	}
+	val, ok := fr.rooms.rooms.Load(strings.ToUpper(roomCode))
+	if !ok {
+		return func() {}
+	}
+	room := val.(*Room)
+	touch := func() {
+		room.Touch()
+		room.LastRelay.Store(time.Now().UnixNano())
+	}
+
+	touch()
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(30 * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				touch()
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		touch()
+	}
+}
+
+// acquireDownload counts a download of fileID against
+// MaxDownloadsPerFile, so one popular file can't monopolise disk I/O.
+func (fr *FileRelay) acquireDownload(fileID string) bool {
+	if fr.cfg.MaxDownloadsPerFile <= 0 {
+		return true
+	}
+	fr.downloadsMu.Lock()
+	defer fr.downloadsMu.Unlock()
+	if fr.downloads[fileID] >= fr.cfg.MaxDownloadsPerFile {
+		return false
+	}
+	fr.downloads[fileID]++
+	return true
+}
+
+func (fr *FileRelay) releaseDownload(fileID string) {
+	if fr.cfg.MaxDownloadsPerFile <= 0 {
+		return
+	}
+	fr.downloadsMu.Lock()
+	defer fr.downloadsMu.Unlock()
+	if fr.downloads[fileID]--; fr.downloads[fileID] <= 0 {
+		delete(fr.downloads, fileID)
+	}
+}
+
+// errReader remembers the first non-EOF error from r, so a failed store
+// can tell a client that went away from storage that broke.
+type errReader struct {
+	r   io.Reader
+	err error
+}
+
+func (e *errReader) Read(p []byte) (int, error) {
+	n, err := e.r.Read(p)
+	if err != nil && err != io.EOF && e.err == nil {
+		e.err = err
+	}
+	return n, err
+}
+
+// breaker fast-fails uploads after threshold consecutive storage write
+// failures, for cooldown, so a dying disk is not hammered by every client.
+// Downloads never consult it.
+type breaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	openUntil time.Time
+}
+
+func newBreaker(threshold int, cooldown time.Duration) *breaker {
+	return &breaker{threshold: threshold, cooldown: cooldown}
+}
+
+// Allow reports whether a write may be attempted. Once the cooldown ends,
+// writes go through again; the next failure re-opens the breaker at once.
+func (b *breaker) Allow() bool {
+	if b.threshold <= 0 {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return !time.Now().Before(b.openUntil)
+}
+
+// Open reports whether the breaker is currently refusing writes.
+func (b *breaker) Open() bool {
+	return !b.Allow()
+}
+
+func (b *breaker) Success() {
+	b.mu.Lock()
+	b.failures = 0
+	b.mu.Unlock()
+}
+
+func (b *breaker) Failure() {
+	if b.threshold <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	if b.failures >= b.threshold {
+		b.openUntil = time.Now().Add(b.cooldown)
+		log.Printf("[Relay] Storage breaker open for %s after %d write failures", b.cooldown, b.failures)
+	}
+}
+
+// countingReader tallies bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// serveRange answers a Range request when the bytes to serve are seekable:
+// raw files on a seekable backend, or compressed files through the range
+// cache. It returns false to fall back to a plain full-body response.
+func (fr *FileRelay) serveRange(w http.ResponseWriter, r *http.Request, meta *FileMeta, file io.ReadCloser, decompress bool) bool {
+	content := file
+	if meta.Compressed && decompress {
+		cached, err := fr.rangeCache(meta)
+		if err != nil {
+			return false
+		}
+		defer cached.Close()
+		content = cached
+	}
+	rs, ok := content.(io.ReadSeeker)
+	if !ok {
+		return false
+	}
+
+	var src io.Reader = &ctxReader{ctx: r.Context(), r: rs}
+	if rate := fr.downloadRate(r); rate > 0 {
+		src = newRateLimitedReader(r.Context(), src, rate)
+	}
+	counted := &countingReader{r: src}
+	http.ServeContent(w, r, meta.Name, time.Unix(int64(meta.UploadedAt), 0), struct {
+		io.Reader
+		io.Seeker
+	}{counted, rs})
+	fr.rooms.totalBytesRelay.Add(counted.n)
+	fr.audit.Record(r, meta.ID, counted.n)
+	return true
+}
+
+// rangeCache opens the decompressed copy of a compressed file, building it
+// on first use. Files over RangeCacheMax are never cached, which bounds the
+// extra disk a burst of resumed downloads can claim.
+func (fr *FileRelay) rangeCache(meta *FileMeta) (io.ReadCloser, error) {
+	if fr.cfg.RangeCacheMax <= 0 || meta.OriginalSize > fr.cfg.RangeCacheMax {
+		return nil, errors.New("range cache disabled")
+	}
+
+	val, _ := fr.rangeMu.LoadOrStore(meta.ID, &sync.Mutex{})
+	mu := val.(*sync.Mutex)
+	mu.Lock()
+	defer mu.Unlock()
+
+	key := meta.rangeCacheKey()
+	if size, err := fr.storage.Stat(key); err != nil || size != meta.OriginalSize {
+		src, err := fr.storage.Get(meta.storageKey())
+		if err != nil {
+			return nil, err
+		}
+		_, err = fr.storage.Put(key, lz4.NewReader(src))
+		src.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return fr.storage.Get(key)
+}
+
+const maxChunkSize = 16 * 1024 * 1024
+
+// DownloadChunk serves GET /api/relay/download/{id}/chunk?index=N&size=S:
+// the Nth S-byte slice of the decompressed file, with its SHA-256 in
+// X-Chunk-SHA256 so parallel downloaders can verify and retry per chunk.
+// S defaults to ChunkSize. The chunk is buffered to hash it, hence the cap.
+func (fr *FileRelay) DownloadChunk(w http.ResponseWriter, r *http.Request, meta *FileMeta) {
+	size := int64(fr.cfg.ChunkSize)
+	if v := r.URL.Query().Get("size"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n <= 0 || n > maxChunkSize {
+			http.Error(w, fmt.Sprintf("Invalid chunk size (1-%d)", maxChunkSize), http.StatusBadRequest)
+			return
+		}
+		size = n
+	}
+	index, err := strconv.ParseInt(r.URL.Query().Get("index"), 10, 64)
+	if err != nil || index < 0 {
+		http.Error(w, "Invalid chunk index", http.StatusBadRequest)
+		return
+	}
+	count := (meta.OriginalSize + size - 1) / size
+	if index >= count {
+		w.Header().Set("X-Chunk-Count", strconv.FormatInt(count, 10))
+		http.Error(w, "Chunk index out of range", http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+	offset := index * size
+
+	// Seek when the bytes are seekable (raw file, or the range cache);
+	// otherwise decompress from the start and skip to offset.
+	var file io.ReadCloser
+	if meta.Compressed {
+		file, err = fr.rangeCache(meta)
+		if err != nil {
+			file, err = fr.storage.Get(meta.storageKey())
+			if err == nil {
+				file = struct {
+					io.Reader
+					io.Closer
+				}{lz4.NewReader(file), file}
+			}
+		}
+	} else {
+		file, err = fr.storage.Get(meta.storageKey())
+	}
+	if err != nil {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	defer file.Close()
+
+	var src io.Reader = &ctxReader{ctx: r.Context(), r: file}
+	if seeker, ok := file.(io.Seeker); ok {
+		if _, err := seeker.Seek(offset, io.SeekStart); err != nil {
+			http.Error(w, "Read error", http.StatusInternalServerError)
+			return
+		}
+	} else if _, err := io.CopyN(io.Discard, src, offset); err != nil {
+		http.Error(w, "Read error", http.StatusInternalServerError)
+		return
+	}
+
+	chunk := make([]byte, min(size, meta.OriginalSize-offset))
+	if _, err := io.ReadFull(src, chunk); err != nil {
+		http.Error(w, "Read error", http.StatusInternalServerError)
+		return
+	}
+	sum := sha256.Sum256(chunk)
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.Itoa(len(chunk)))
+	w.Header().Set("X-Chunk-Index", strconv.FormatInt(index, 10))
+	w.Header().Set("X-Chunk-Count", strconv.FormatInt(count, 10))
+	w.Header().Set("X-Chunk-Offset", strconv.FormatInt(offset, 10))
+	w.Header().Set("X-Chunk-SHA256", hex.EncodeToString(sum[:]))
+	w.Header().Set("X-Original-Size", strconv.FormatInt(meta.OriginalSize, 10))
+	for name, value := range fr.cfg.DownloadHeaders {
+		w.Header().Set(name, value)
+	}
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+
+	var out io.Reader = bytes.NewReader(chunk)
+	if rate := fr.downloadRate(r); rate > 0 {
+		out = newRateLimitedReader(r.Context(), out, rate)
+	}
+	n, _ := io.Copy(w, out)
+	fr.rooms.totalBytesRelay.Add(n)
+	fr.audit.Record(r, meta.ID, n)
+}
+
+const maxZipFiles = 100
+
+// DownloadZip handles GET /api/relay/download-zip?ids=a,b,c, streaming the
+// files as one ZIP built on the fly. Every ID is resolved before the first
+// byte is written, so a bad list fails with a proper status instead of a
+// truncated archive.
+func (fr *FileRelay) DownloadZip(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w = fr.watchdog(w)
+	var ids []string
+	for _, id := range strings.Split(r.URL.Query().Get("ids"), ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		http.Error(w, "No file IDs", http.StatusBadRequest)
+		return
+	}
+	if len(ids) > maxZipFiles {
+		http.Error(w, "Too many files", http.StatusBadRequest)
+		return
+	}
+	if !fr.cfg.checkDownloadSig(w, r, strings.Join(ids, ",")) {
+		return
+	}
+
+	metas := make([]*FileMeta, 0, len(ids))
+	for _, id := range ids {
+		if !validFileID(id) {
+			http.Error(w, "Invalid file ID", http.StatusBadRequest)
+			return
+		}
+		meta, ok := fr.lookup(id)
+		if !ok {
+			http.Error(w, "File not found: "+id, http.StatusNotFound)
+			return
+		}
+		metas = append(metas, meta)
+	}
+
+	// The archive reads every file, so it holds a download slot on each
+	// (once, even if an ID is listed twice)
+	held := make(map[string]bool, len(metas))
+	defer func() {
+		for id := range held {
+			fr.releaseDownload(id)
+		}
+	}()
+	for _, meta := range metas {
+		if held[meta.ID] {
+			continue
+		}
+		if !fr.acquireDownload(meta.ID) {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "Too many concurrent downloads of "+meta.ID, http.StatusTooManyRequests)
+			return
+		}
+		held[meta.ID] = true
+	}
+	rooms := make(map[string]bool)
+	for _, meta := range metas {
+		if !rooms[meta.RoomCode] {
+			rooms[meta.RoomCode] = true
+			defer fr.keepRoomAlive(meta.RoomCode)()
+		}
+	}
+
+	archive := "sendit-files.zip"
+	if room := metas[0].RoomCode; room != "" {
+		archive = "sendit-" + room + ".zip"
+		for _, m := range metas {
+			if m.RoomCode != room {
+				archive = "sendit-files.zip"
+				break
+			}
+		}
+	}
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, archive))
+	for name, value := range fr.cfg.DownloadHeaders {
+		w.Header().Set(name, value)
+	}
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+
+	buf := fr.bufs.get()
+	defer fr.bufs.put(buf)
+
+	zw := zip.NewWriter(w)
+	used := make(map[string]bool)
+	var total int64
+	for _, meta := range metas {
+		file, err := fr.storage.Get(meta.storageKey())
+		if err != nil {
+			// Headers are gone; all we can do is cut the archive short
+			log.Printf("[Relay] Zip entry %s unavailable: %v", meta.ID, err)
+			return
+		}
+
+		header := &zip.FileHeader{
+			Name:     zipEntryName(meta.Name, used),
+			Method:   zip.Deflate,
+			Modified: time.Unix(int64(meta.UploadedAt), 0),
+		}
+		if meta.CompressReason == "incompressible" {
+			header.Method = zip.Store
+		}
+		entry, err := zw.CreateHeader(header)
+		if err != nil {
+			file.Close()
+			return
+		}
+
+		var src io.Reader = &ctxReader{ctx: r.Context(), r: file}
+		if meta.Compressed {
+			src = &ctxReader{ctx: r.Context(), r: lz4.NewReader(file)}
+		}
+		if rate := fr.downloadRate(r); rate > 0 {
+			src = newRateLimitedReader(r.Context(), src, rate)
+		}
+		n, err := io.CopyBuffer(entry, src, *buf)
+		file.Close()
+		total += n
+		fr.audit.Record(r, meta.ID, n)
+		if err != nil {
+			fr.rooms.totalBytesRelay.Add(total)
+			return
+		}
+	}
+	zw.Close()
+	fr.rooms.totalBytesRelay.Add(total)
+}
+
+// zipEntryName flattens name to a single path element and suffixes repeats
+// ("a.txt", "a (1).txt") so entries never collide or escape the archive.
+func zipEntryName(name string, used map[string]bool) string {
+	name = strings.NewReplacer("/", "_", "\\", "_").Replace(name)
+	if name == "" || name == "." || name == ".." {
+		name = "file"
+	}
+	base, ext := name, ""
+	if i := strings.LastIndex(name, "."); i > 0 {
+		base, ext = name[:i], name[i:]
+	}
+	for n := 0; ; n++ {
+		candidate := name
+		if n > 0 {
+			candidate = fmt.Sprintf("%s (%d)%s", base, n, ext)
+		}
+		if !used[candidate] {
+			used[candidate] = true
+			return candidate
+		}
+	}
+}
+
+func (fr *FileRelay) CleanupLoop() {
+	ticker := time.NewTicker(5 * time.Minute)
+	defer ticker.Stop()
+	for range ticker.C {
+		now := float64(time.Now().Unix())
+		count := 0
+		fr.files.Range(func(key, value interface{}) bool {
+			meta := value.(*FileMeta)
+			if meta.ExpiresAt > 0 && now > meta.ExpiresAt && fr.removeFile(meta) {
+				count++
+			}
+			return true
+		})
+		if count > 0 {
+			log.Printf("[Relay Cleanup] Removed %d expired files", count)
+		}
+		if local, ok := fr.storage.(staleTempRemover); ok {
+			if n := local.RemoveStaleTemp(time.Hour); n > 0 {
+				log.Printf("[Relay Cleanup] Removed %d stale temp files", n)
+			}
+		}
+
+		fr.tickets.Range(func(key, value interface{}) bool {
+			if time.Now().After(value.(*uploadTicket).ExpiresAt) {
+				fr.tickets.Delete(key)
+			}
+			return true
+		})
+	}
+}
+
+// ============================================
+// Download Audit Log
+// ============================================
+
+const auditQueueSize = 4096
+
+// auditLog writes one JSON line per served download to its own stream,
+// separate from the server log. Records are queued and written by a single
+// goroutine; when the queue is full they are dropped (and counted) rather
+// than ever stalling a download.
+type auditLog struct {
+	out     io.Writer
+	queue   chan []byte
+	dropped atomic.Int64
+}
+
+func newAuditLog(dest string) (*auditLog, error) {
+	var out io.Writer
+	switch dest {
+	case "":
+		return nil, nil
+	case "stdout":
+		out = os.Stdout
+	case "stderr":
+		out = os.Stderr
+	default:
+		f, err := os.OpenFile(dest, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0640)
+		if err != nil {
+			return nil, err
+		}
+		out = f
+	}
+	a := &auditLog{out: out, queue: make(chan []byte, auditQueueSize)}
+	go a.run()
+	return a, nil
+}
+
+func (a *auditLog) run() {
+	for line := range a.queue {
+		if _, err := a.out.Write(line); err != nil {
+			log.Printf("[Audit] Write failed: %v", err)
+		}
+	}
+}
+
+// Record logs bytes of fileID served to r's client. Safe on a nil log.
+func (a *auditLog) Record(r *http.Request, fileID string, bytes int64) {
+	if a == nil {
+		return
+	}
+	line, _ := json.Marshal(map[string]interface{}{
+		"ts":        time.Now().UTC().Format(time.RFC3339Nano),
+		"event":     "download",
+		"fileId":    fileID,
+		"ip":        clientIP(r),
+		"userAgent": r.UserAgent(),
+		"bytes":     bytes,
+		"path":      r.URL.Path,
+	})
+	select {
+	case a.queue <- append(line, '\n'):
+	default:
+		if a.dropped.Add(1)%1000 == 1 {
+			log.Printf("[Audit] Queue full, %d records dropped so far", a.dropped.Load())
+		}
+	}
+}
+
+// ============================================
+// Admission Control
+// ============================================
+
+// admission caps concurrent peers server-wide. Joiners over the cap wait
+// in a bounded FIFO and inherit slots in arrival order as peers leave.
+type admission struct {
+	mu       sync.Mutex
+	max      int
+	maxQueue int
+	active   int
+	queue    *list.List // of chan struct{}, closed when admitted
+}
+
+func newAdmission(max, maxQueue int) *admission {
+	return &admission{max: max, maxQueue: maxQueue, queue: list.New()}
+}
+
+// Acquire takes a slot immediately (nil element) or enqueues the caller,
+// whose channel is closed once a slot is handed over. ok is false when
+// the queue is full.
+func (a *admission) Acquire() (e *list.Element, ok bool) {
+	if a.max <= 0 {
+		return nil, true
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.active < a.max && a.queue.Len() == 0 {
+		a.active++
+		return nil, true
+	}
+	if a.queue.Len() >= a.maxQueue {
+		return nil, false
+	}
+	return a.queue.PushBack(make(chan struct{})), true
+}
+
+// Position is e's 1-based place in the queue, or 0 once admitted.
+func (a *admission) Position(e *list.Element) int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	pos := 1
+	for cur := a.queue.Front(); cur != nil; cur = cur.Next() {
+		if cur == e {
+			return pos
+		}
+		pos++
+	}
+	return 0
+}
+
+// Cancel withdraws a queued caller. If its slot was granted in the
+// meantime, the slot is released instead.
+func (a *admission) Cancel(e *list.Element) {
+	a.mu.Lock()
+	select {
+	case <-e.Value.(chan struct{}):
+		a.mu.Unlock()
+		a.Release()
+	default:
+		a.queue.Remove(e)
+		a.mu.Unlock()
+	}
+}
+
+// Release frees a slot, handing it straight to the longest waiter.
+func (a *admission) Release() {
+	if a.max <= 0 {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if front := a.queue.Front(); front != nil {
+		close(a.queue.Remove(front).(chan struct{}))
+		return
+	}
+	a.active--
+}
+
+const admissionPollInterval = 5 * time.Second
+
+// awaitAdmission holds conn until a peer slot is free, keeping the client
+// informed with {"type":"queued","position":N}. A client that disconnects
+// while queued is noticed on the next update and gives up its place.
+func (s *Server) awaitAdmission(conn *websocket.Conn, ip string) bool {
+	e, ok := s.admit.Acquire()
+	if !ok {
+		writeConnJSON(conn, map[string]string{
+			"type":    "error",
+			"code":    "SERVER_FULL",
+			"message": "Server is at capacity, try again later",
+		})
+		return false
+	}
+	if e == nil {
+		return true
+	}
+
+	// Queued sockets count against MaxConnsPerIP alongside joined ones, or
+	// one client could fill the queue and lock everyone else out.
+	queued := "queued:" + ip
+	s.rooms.limits.Adjust(queued, 1)
+	defer s.rooms.limits.Adjust(queued, -1)
+	if s.rooms.ipConns(ip) > int64(s.cfg.MaxConnsPerIP) {
+		s.admit.Cancel(e)
+		writeTooManyConns(conn)
+		return false
+	}
+
+	ready := e.Value.(chan struct{})
+	ticker := time.NewTicker(admissionPollInterval)
+	defer ticker.Stop()
+	last := 0
+	for {
+		if pos := s.admit.Position(e); pos > 0 && pos != last {
+			last = pos
+			if err := writeConnJSON(conn, map[string]interface{}{"type": "queued", "position": pos}); err != nil {
+				s.admit.Cancel(e)
+				return false
+			}
+		}
+		select {
+		case <-ready:
+			return true
+		case <-ticker.C:
+			err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(time.Second))
+			if err != nil {
+				s.admit.Cancel(e)
+				return false
+			}
+		}
+	}
+}
+
+func writeTooManyConns(conn *websocket.Conn) {
+	writeConnJSON(conn, map[string]string{
+		"type":    "error",
+		"code":    "TOO_MANY_CONNECTIONS",
+		"message": "Too many connections from this address",
+	})
+}
+
+// maxHelloSize caps the hello frame; it only carries a version
+const maxHelloSize = 4096
+
+// awaitHello waits up to HelloTimeout for the client's first message to be
+// {"type":"hello","version":...}, so scanners and bots that open a socket
+// but never speak the protocol are dropped before they join a room or take
+// an admission slot. Sockets waiting here count against MaxConnsPerIP.
+func (s *Server) awaitHello(conn *websocket.Conn, ip string) bool {
+	waiting := "hello:" + ip
+	s.rooms.limits.Adjust(waiting, 1)
+	defer s.rooms.limits.Adjust(waiting, -1)
+	if s.rooms.ipConns(ip) > int64(s.cfg.MaxConnsPerIP) {
+		writeTooManyConns(conn)
+		return false
+	}
+
+	conn.SetReadLimit(maxHelloSize)
+	conn.SetReadDeadline(time.Now().Add(s.cfg.HelloTimeout))
+	frameType, data, err := conn.ReadMessage()
+	if err != nil {
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			writeConnJSON(conn, map[string]string{
+				"type":    "error",
+				"code":    "HANDSHAKE_TIMEOUT",
+				"message": fmt.Sprintf("Send hello within %s of connecting", s.cfg.HelloTimeout),
+			})
+		}
+		return false
+	}
+	if frameType == websocket.BinaryMessage && conn.Subprotocol() == dictSubprotocol {
+		data, err = dictDecompress(data, maxHelloSize)
+	}
+
+	var hello struct {
+		Type    string      `json:"type"`
+		Version interface{} `json:"version"` // string or number
+	}
+	valid := err == nil && json.Unmarshal(data, &hello) == nil && hello.Type == "hello"
+	switch v := hello.Version.(type) {
+	case string:
+		valid = valid && v != ""
+	case float64:
+	default:
+		valid = false
+	}
+	if !valid {
+		writeConnJSON(conn, map[string]string{
+			"type":    "error",
+			"code":    "INVALID_HELLO",
+			"message": `First message must be {"type":"hello","version":...}`,
+		})
+		return false
+	}
+	return true
+}
+
+// ============================================
+// WebSocket Handler
+// ============================================
+
+// batchSubprotocol opts a connection into batched delivery, as does
+// ?batch=true; see Peer.batchWindow.
+const batchSubprotocol = "sendit.batch.v1"
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  16 * 1024,
+	WriteBufferSize: 16 * 1024,
+	CheckOrigin:     func(r *http.Request) bool { return true },
+	Subprotocols:    []string{batchSubprotocol, dictSubprotocol},
+}
+
+// logPanic recovers a panic on a connection's goroutine and logs it with
+// a stack. It must be deferred first, so the peer cleanup deferred after
+// it (RemovePeer, admission and room slots) has already run when it logs.
+func logPanic(where string) {
+	if v := recover(); v != nil {
+		log.Printf("[WS] Panic in %s: %v\n%s", where, v, debug.Stack())
+	}
+}
+
+// headerSize approximates the bytes of r's request line and headers as
+// they arrived on the wire.
+func headerSize(r *http.Request) int {
+	n := len(r.Method) + len(r.RequestURI) + len(r.Proto) + 4
+	n += len(r.Host) + len("Host: \r\n")
+	for key, values := range r.Header {
+		for _, v := range values {
+			n += len(key) + len(v) + 4 // ": " and CRLF
+		}
+	}
+	return n
+}
+
+func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	defer logPanic(r.URL.Path + " from " + clientIP(r))
+	// Signaling clients send a handful of short headers; the server-wide
+	// MaxHeaderBytes is sized for API clients, so hold upgrades to less.
+	if len(r.URL.RawQuery) > s.cfg.WSMaxQueryLen || headerSize(r) > s.cfg.WSMaxHeaderBytes {
+		http.Error(w, "Request header fields too large", http.StatusRequestHeaderFieldsTooLarge)
+		return
+	}
+
+	// Extract room code from path: /ws/{roomCode}
+	pathParts := strings.Split(strings.TrimPrefix(r.URL.Path, "/ws/"), "/")
+	if len(pathParts) == 0 || pathParts[0] == "" {
+		http.Error(w, "Room code required", http.StatusBadRequest)
+		return
+	}
+	roomCode, ok := s.rooms.NormalizeCode(pathParts[0])
+	if !ok {
+		http.Error(w, "Invalid room code", http.StatusBadRequest)
+		return
+	}
+
+	peerID := r.URL.Query().Get("peer_id")
+	isHost := r.URL.Query().Get("is_host") == "true"
+	mayCreate := isHost || s.cfg.GuestCreatesRoom
+	clientIP := clientIP(r)
+
+	if peerID != "" && !validPeerID(peerID) {
+		http.Error(w, "Invalid peer_id", http.StatusBadRequest)
+		return
+	}
+
+	if s.rooms.Reserved(roomCode) {
+		http.Error(w, "Room code is reserved", http.StatusForbidden)
+		return
+	}
+
+	if msg := s.maintenance.Load(); msg != nil {
+		http.Error(w, *msg, http.StatusServiceUnavailable)
+		return
+	}
+
+	if err := s.cfg.verifyJoin(peerID, roomCode, r.URL.Query().Get("ts"), r.URL.Query().Get("sig")); err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	// The upgrade hijacks an HTTP/1.1 connection; over HTTP/2 (RFC 8441
+	// extended CONNECT) there is nothing to hijack. This usually means a
+	// proxy speaks h2 to us and needs WebSocket passthrough on HTTP/1.1.
+	if r.ProtoMajor != 1 {
+		log.Printf("[WS] Rejected %s upgrade from %s for %s: proxy must forward WebSockets over HTTP/1.1", r.Proto, clientIP, r.URL.Path)
+		http.Error(w, "WebSocket over "+r.Proto+" is not supported; connect over HTTP/1.1 (check proxy WebSocket settings)", http.StatusBadRequest)
+		return
+	}
+
+	if !s.rooms.CheckIPLimit(clientIP) {
+		http.Error(w, "Too many connections", http.StatusTooManyRequests)
+		return
+	}
+	if mayCreate && !s.rooms.CanCreateRoom(clientIP) && s.rooms.GetRoom(roomCode) == nil {
+		http.Error(w, "Too many rooms", http.StatusTooManyRequests)
+		return
+	}
+
+	up := upgrader
+	up.EnableCompression = s.cfg.WSCompression
+	hj := &countingHijacker{ResponseWriter: w}
+	conn, err := up.Upgrade(hj, r, nil)
+	if err != nil {
+		log.Printf("[WS] Upgrade error: %v", err)
+		return
+	}
+	defer conn.Close()
+	hj.conn.written.Store(0) // don't count the handshake response
+	deflate := s.cfg.WSCompression && strings.Contains(r.Header.Get("Sec-WebSocket-Extensions"), "permessage-deflate")
+	if deflate {
+		hj.conn.totals = &s.rooms.deflate
+	}
+
+	if s.cfg.RequireHello && !s.awaitHello(conn, clientIP) {
+		return
+	}
+
+	if !s.awaitAdmission(conn, clientIP) {
+		return
+	}
+	defer s.admit.Release()
+
+	if !s.rooms.AllowReconnect(roomCode, peerID) {
+		writeConnJSON(conn, map[string]interface{}{
+			"type":       "error",
+			"code":       "RECONNECT_BACKOFF",
+			"message":    "Reconnecting too often, retry later",
+			"retryAfter": int(s.cfg.ReconnectWindow.Seconds()),
+		})
+		return
+	}
+
+	// Get or create room
+	room := s.rooms.GetRoom(roomCode)
+	created := false
+	if room == nil {
+		if s.rooms.Tombstoned(roomCode) {
+			writeConnJSON(conn, map[string]string{
+				"type":    "error",
+				"code":    "ROOM_CLOSED",
+				"message": "Room has closed",
+			})
+			return
+		}
+		if mayCreate {
+			var err error
+			switch room, created, err = s.rooms.GetOrCreateRoom(clientIP, roomCode); err {
+			case nil:
+			case errRoomLimit:
+				writeConnJSON(conn, map[string]string{
+					"type":    "error",
+					"code":    "ROOM_LIMIT",
+					"message": "Server has reached its room limit, try again later",
+				})
+				return
+			default:
+				writeConnJSON(conn, map[string]string{
+					"type":    "error",
+					"code":    "TOO_MANY_ROOMS",
+					"message": "Too many rooms",
+				})
+				return
+			}
+		} else {
+			writeConnJSON(conn, map[string]string{
+				"type":    "error",
+				"code":    "ROOM_NOT_FOUND",
+				"message": "Room not found",
+			})
+			return
+		}
+	}
+
+	// A room created for this connection must not outlive a rejection below,
+	// or it would hold its creator's room slot until it expires.
+	if created {
+		defer func() {
+			if room.PeerCount() == 0 {
+				s.rooms.discardRoom(room)
+			}
+		}()
+	}
+
+	// A supplied peer_id must be unique in the room, unless the client is
+	// reconnecting with the token its earlier connection got in room-joined,
+	// in which case the stale connection is replaced. Peer IDs are public,
+	// and clients behind one NAT share an IP, so nothing else proves it.
+	if peerID != "" {
+		duplicate := false
+		if val, ok := room.Peers.Load(peerID); ok {
+			token := r.URL.Query().Get("reconnect_token")
+			if old := val.(*Peer); token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(old.reconnectToken)) == 1 {
+				s.rooms.evictStale(room, old)
+			} else {
+				duplicate = true
+			}
+		} else if s.rooms.cluster != nil {
+			_, duplicate = s.rooms.cluster.Roster(roomCode)[peerID]
+		}
+		if duplicate {
+			writeConnJSON(conn, map[string]string{
+				"type":    "error",
+				"code":    "DUPLICATE_PEER_ID",
+				"message": "Peer ID already in use",
+			})
+			return
+		}
+	}
+
+	if s.rooms.TotalPeers(room) >= s.cfg.MaxPeersPerRoom {
+		writeConnJSON(conn, map[string]string{
+			"type":    "error",
+			"code":    "ROOM_FULL",
+			"message": "Room is full",
+		})
+		return
+	}
+
+	if peerID == "" {
+		b := make([]byte, 8)
+		rand.Read(b)
+		peerID = hex.EncodeToString(b)
+	}
+
+	token := make([]byte, 16)
+	rand.Read(token)
+
+	peer := &Peer{
+		ID:             peerID,
+		Conn:           conn,
+		RoomCode:       roomCode,
+		IP:             clientIP,
+		ConnectedAt:    time.Now(),
+		wire:           hj.conn,
+		deflate:        deflate,
+		dict:           conn.Subprotocol() == dictSubprotocol,
+		reconnectToken: hex.EncodeToString(token),
+		pingInterval:   s.cfg.PingInterval, // set before AddPeer publishes the peer
+	}
+
+	peer.host.Store(isHost)
+	if conn.Subprotocol() == batchSubprotocol || r.URL.Query().Get("batch") == "true" {
+		peer.batchWindow = s.cfg.BatchWindow
+	}
+
+	// Only connections that reach AddPeer are counted, and RemovePeer runs
+	// against the same room even if cleanup has already unregistered it, so
+	// the IP and room counters are released exactly once.
+	s.rooms.AddPeer(room, peer)
+	defer s.rooms.RemovePeer(room, peer)
+
+	// Read loop
+	// The read deadline has to outlast the longest ping interval, or a
+	// quiet peer on a good link would time out between pings.
+	readWait := 60 * time.Second
+	if 2*s.cfg.PingMax > readWait {
+		readWait = 2 * s.cfg.PingMax
+	}
+	conn.SetReadLimit(room.readLimit(s.cfg.MaxMessageSize))
+	conn.SetReadDeadline(time.Now().Add(readWait))
+	conn.SetPongHandler(func(string) error {
+		peer.ponged()
+		peer.missedPongs.Store(0)
+		conn.SetReadDeadline(time.Now().Add(readWait))
+		return nil
+	})
+
+	// Ping loop: a peer that leaves MaxMissedPongs pings unanswered is dead,
+	// even if it is still inside the read deadline. The interval starts at
+	// PingInterval and adapts to the link between PingMin and PingMax.
+	go func() {
+		// A panic here would take down the process, not just this peer
+		defer logPanic("ping loop for " + peerID)
+		defer peer.markDead()
+		timer := time.NewTimer(peer.nextPing(s.cfg.PingMin, s.cfg.PingMax))
+		defer timer.Stop()
+		for range timer.C {
+			if s.cfg.MaxMissedPongs > 0 && int(peer.missedPongs.Load()) >= s.cfg.MaxMissedPongs {
+				log.Printf("[WS] Peer %s in %s missed %d pongs, closing", peerID, roomCode, s.cfg.MaxMissedPongs)
+				conn.WriteControl(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseGoingAway, "ping-timeout"),
+					time.Now().Add(time.Second))
+				peer.markDead()
+				return
+			}
+			// Decided before counting this ping, so a pong still owed
+			// from the last one is what tightens the interval
+			next := peer.nextPing(s.cfg.PingMin, s.cfg.PingMax)
+			peer.missedPongs.Add(1)
+
+			peer.mu.Lock()
+			peer.pinged()
+			err := conn.WriteMessage(websocket.PingMessage, nil)
+			peer.mu.Unlock()
+			if err != nil {
+				peer.markDead()
+				return
+			}
+			timer.Reset(next)
+		}
+	}()
+
+	for {
+		frameType, msgBytes, err := conn.ReadMessage()
+		if err != nil {
+			break
+		}
+		conn.SetReadDeadline(time.Now().Add(readWait))
+		peer.recvMsgs.Add(1)
+		peer.recvBytes.Add(int64(len(msgBytes)))
+		if peer.dict && frameType == websocket.BinaryMessage {
+			if msgBytes, err = dictDecompress(msgBytes, room.readLimit(s.cfg.MaxMessageSize)); err != nil {
+				peer.SendJSON(map[string]interface{}{
+					"type":    "error",
+					"code":    "BAD_FRAME",
+					"message": "Could not inflate frame: " + err.Error(),
+				})
+				continue
+			}
+		}
+
+		var msg map[string]interface{}
+		if err := json.Unmarshal(msgBytes, &msg); err != nil {
+			continue
+		}
+
+		msgType, _ := msg["type"].(string)
+		if msgType == "" {
+			peer.SendJSON(map[string]interface{}{
+				"type":    "error",
+				"code":    "MISSING_TYPE",
+				"message": "Message type is required",
+			})
+			continue
+		}
+
+		if s.cfg.LogPayloads {
+			logPayload(roomCode, peerID, msg)
+		}
+
+		if !s.rooms.AllowMessage(roomCode, peerID) {
+			peer.SendJSON(map[string]interface{}{
+				"type":    "error",
+				"code":    "RATE_LIMITED",
+				"message": "Too many messages",
+			})
+			continue
+		}
+		if limit, ok := s.rooms.AllowMessageType(roomCode, peerID, msgType); !ok {
+			peer.SendJSON(map[string]interface{}{
+				"type":        "error",
+				"code":        "TYPE_RATE_LIMITED",
+				"message":     fmt.Sprintf("Too many %s messages (max %d/s)", msgType, limit),
+				"messageType": msgType,
+			})
+			continue
+		}
+
+		// Drop client retries of a message we already relayed
+		if msgID, _ := msg["msgId"].(string); msgID != "" && s.cfg.MsgDedupWindow > 0 {
+			if peer.isDuplicate(msgID, s.cfg.MsgDedupWindow) {
+				continue
+			}
+		}
+
+		if s.handleControl(r, room, peer, msgType, msg) {
+			continue
+		}
+		s.rooms.RelayMessage(room, peerID, msg, len(msgBytes))
+	}
+}
+
+// opaqueFields are end-to-end encrypted by clients. The server relays them
+// verbatim and never inspects or logs their contents, whatever the config.
+var opaqueFields = []string{"ciphertext"}
+
+// logPayload prints a signaling message for debugging. It is only called
+// when SENDIT_LOG_PAYLOADS is set; opaque fields are reduced to a length.
+func logPayload(roomCode, peerID string, msg map[string]interface{}) {
+	redacted := make(map[string]interface{}, len(msg))
+	for k, v := range msg {
+		redacted[k] = v
+	}
+	for _, field := range opaqueFields {
+		if v, ok := redacted[field]; ok {
+			s, _ := v.(string)
+			redacted[field] = fmt.Sprintf("<opaque %d bytes>", len(s))
+		}
+	}
+	data, _ := json.Marshal(redacted)
+	log.Printf("[WS] %s/%s: %s", roomCode, peerID, data)
+}
+
+// verifyJoin checks a backend-minted join signature when JoinHMACKey or
+// JoinEd25519Key is configured. The signed message is
+//
+//	peerId + "\n" + roomCode + "\n" + ts
+//
+// with roomCode upper-cased, ts in unix seconds, and sig base64url
+// (unpadded). Without a key configured every join is accepted.
+func (c *Config) verifyJoin(peerID, roomCode, ts, sig string) error {
+	if len(c.JoinHMACKey) == 0 && c.JoinEd25519Key == nil {
+		return nil
+	}
+	if peerID == "" || ts == "" || sig == "" {
+		return errors.New("peer_id, ts and sig are required")
+	}
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return errors.New("invalid ts")
+	}
+	if age := time.Since(time.Unix(unix, 0)); age > c.JoinSigMaxAge || age < -c.JoinSigMaxAge {
+		return errors.New("join signature expired")
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil {
+		return errors.New("invalid sig encoding")
+	}
+
+	msg := []byte(peerID + "\n" + roomCode + "\n" + ts)
+	if c.JoinEd25519Key != nil && ed25519.Verify(c.JoinEd25519Key, msg, raw) {
+		return nil
+	}
+	if len(c.JoinHMACKey) > 0 {
+		mac := hmac.New(sha256.New, c.JoinHMACKey)
+		mac.Write(msg)
+		if hmac.Equal(mac.Sum(nil), raw) {
+			return nil
+		}
+	}
+	return errors.New("invalid join signature")
+}
+
+// handleControl acts on message types the server itself understands. It
+// returns true when msg was fully handled and must not be relayed.
+func (s *Server) handleControl(r *http.Request, room *Room, peer *Peer, msgType string, msg map[string]interface{}) bool {
+	switch msgType {
+	case "request-relay":
+		// P2P failed: hand the requester a room-scoped upload ticket, and
+		// still relay the request so the other side knows to expect it.
+		ticket := s.relay.TicketFor(peer.relayTicket, room.Code)
+		peer.relayTicket = ticket.Token
+		base := s.cfg.BaseURL(r)
+		peer.SendJSON(map[string]interface{}{
+			"type":         "relay-info",
+			"uploadToken":  ticket.Token,
+			"uploadUrl":    fmt.Sprintf("%s/api/relay/upload?token=%s", base, ticket.Token),
+			"rawUploadUrl": fmt.Sprintf("%s/api/relay/upload/raw?token=%s", base, ticket.Token),
+			"expiresAt":    ticket.ExpiresAt.Unix(),
+			"maxFileSize":  s.cfg.MaxFileSize,
+		})
+
+	case "get-peers":
+		// Roster refresh for clients that missed room-joined; never relayed
+		peerIDs := s.rooms.PeerIDs(room, peer.ID)
+		peer.SendJSON(map[string]interface{}{
+			"type":      "peers",
+			"roomCode":  room.Code,
+			"peerId":    peer.ID,
+			"peerCount": len(peerIDs) + 1,
+			"peers":     peerIDs,
+		})
+		return true
+
+	case "get-capabilities":
+		caps := s.capabilities()
+		caps["type"] = "capabilities"
+		peer.SendJSON(caps)
+		return true
+
+	case "get-conn-stats":
+		// Payload bytes sent vs bytes that hit the wire; the gap is what
+		// permessage-deflate saved, less frame overhead. Never relayed.
+		peer.SendJSON(map[string]interface{}{
+			"type":            "conn-stats",
+			"compression":     peer.deflate,
+			"messagesSent":    peer.sentMsgs.Load(),
+			"bytesSent":       peer.sentBytes.Load(),
+			"bytesCompressed": peer.wire.written.Load(),
+			"rttMs":           peer.srttMillis(),
+			"pingIntervalMs":  peer.pingIntervalMillis(),
+		})
+		return true
+
+	case "renegotiate":
+		// Stamp a per-room sequence and relay. When both sides renegotiate
+		// at once (glare), clients let the lower seq win and roll back the
+		// other. Sequences are per instance when clustering.
+		seq := room.renegotiateSeq.Add(1)
+		msg["seq"] = seq
+		peer.SendJSON(map[string]interface{}{
+			"type": "renegotiate-ack",
+			"seq":  seq,
+		})
+
+	case "transfer-offer", "transfer-accept", "transfer-reject":
+		if err := s.checkTransfer(room, peer, msgType, msg); err != nil {
+			peer.SendJSON(map[string]interface{}{
+				"type":    "error",
+				"code":    "INVALID_TRANSFER",
+				"message": err.Error(),
+				"offerId": msg["offerId"],
+			})
+			return true
+		}
+
+	case "adopt-file":
+		fileID, _ := msg["fileId"].(string)
+		token, err := s.relay.Adopt(fileID, room.Code)
+		if err != nil {
+			peer.SendJSON(map[string]interface{}{
+				"type":    "error",
+				"code":    "INVALID_ADOPT",
+				"message": err.Error(),
+				"fileId":  fileID,
+			})
+			return true
+		}
+		log.Printf("[Relay] %s adopted %s in %s", peer.ID, fileID, room.Code)
+		peer.SendJSON(map[string]interface{}{
+			"type":        "file-adopted",
+			"fileId":      fileID,
+			"deleteToken": token,
+		})
+		return true
+
+	case "close-room":
+		if !peer.IsHost() {
+			peer.SendJSON(map[string]interface{}{
+				"type":    "error",
+				"code":    "NOT_HOST",
+				"message": "only the host can close the room",
+			})
+			return true
+		}
+		log.Printf("[Room] %s closed by host %s", room.Code, peer.ID)
+		s.rooms.CloseRoom(room, "host")
+		return true
+
+	case "transfer-host":
+		if err := s.transferHost(room, peer, msg); err != nil {
+			peer.SendJSON(map[string]interface{}{
+				"type":    "error",
+				"code":    "INVALID_HOST_TRANSFER",
+				"message": err.Error(),
+			})
+		}
+		return true
+
+	case "stream-start", "stream-chunk", "stream-ack", "stream-end":
+		if err := s.checkStream(room, peer, msgType, msg); err != nil {
+			code := "INVALID_STREAM"
+			if err == errStreamWindowFull {
+				code = "STREAM_WINDOW_FULL"
+			}
+			peer.SendJSON(map[string]interface{}{
+				"type":     "error",
+				"code":     code,
+				"message":  err.Error(),
+				"streamId": msg["streamId"],
+			})
+			return true
+		}
+	}
+	return false
+}
+
+// maxPendingOffers caps a peer's unanswered transfer-offers.
+const maxPendingOffers = 16
+
+// checkTransfer enforces the transfer negotiation handshake:
+//
+//	sender   -> {"type":"transfer-offer","offerId":"...","files":[{"id","name","size"}]}
+//	receiver -> {"type":"transfer-accept"|"transfer-reject","offerId":"..."}
+//
+// An offer must be well-formed and within limits; an accept/reject must
+// answer a pending offer made by someone else. The server only validates,
+// the messages themselves are relayed unchanged.
+func (s *Server) checkTransfer(room *Room, peer *Peer, msgType string, msg map[string]interface{}) error {
+	offerID, _ := msg["offerId"].(string)
+	if offerID == "" {
+		return errors.New("offerId is required")
+	}
+
+	if msgType != "transfer-offer" {
+		val, ok := room.offers.Load(offerID)
+		if !ok {
+			return errors.New("unknown offerId")
+		}
+		if val.(string) == peer.ID {
+			return errors.New("cannot answer your own offer")
+		}
+		room.offers.Delete(offerID)
+		return nil
+	}
+
+	files, ok := msg["files"].([]interface{})
+	if !ok || len(files) == 0 {
+		return errors.New("files must be a non-empty array")
+	}
+	if len(files) > s.cfg.MaxOfferFiles {
+		return fmt.Errorf("too many files (max %d)", s.cfg.MaxOfferFiles)
+	}
+	for i, v := range files {
+		file, ok := v.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("files[%d] must be an object", i)
+		}
+		if id, _ := file["id"].(string); id == "" {
+			return fmt.Errorf("files[%d].id is required", i)
+		}
+		if name, _ := file["name"].(string); name == "" {
+			return fmt.Errorf("files[%d].name is required", i)
+		}
+		size, ok := file["size"].(float64)
+		if !ok || size < 0 {
+			return fmt.Errorf("files[%d].size must be a non-negative number", i)
+		}
+		if int64(size) > s.cfg.MaxFileSize {
+			return fmt.Errorf("files[%d] exceeds max file size", i)
+		}
+	}
+
+	pending := 0
+	room.offers.Range(func(_, value interface{}) bool {
+		if value.(string) == peer.ID {
+			pending++
+		}
+		return true
+	})
+	if pending >= maxPendingOffers {
+		return fmt.Errorf("too many pending offers (max %d)", maxPendingOffers)
+	}
+	if _, dup := room.offers.LoadOrStore(offerID, peer.ID); dup {
+		return errors.New("offerId already pending")
+	}
+	return nil
+}
+
+// dropOffers forgets peerID's unanswered offers once it has left.
+func (r *Room) dropOffers(peerID string) {
+	r.offers.Range(func(key, value interface{}) bool {
+		if value.(string) == peerID {
+			r.offers.Delete(key)
+		}
+		return true
+	})
+}
+
+// transferHost hands the host role from peer to msg["toPeerId"] and
+// announces it with host-changed. The target must be connected to this
+// instance, since its host flag lives on its connection.
+func (s *Server) transferHost(room *Room, peer *Peer, msg map[string]interface{}) error {
+	if !peer.IsHost() {
+		return errors.New("only the host can transfer the host role")
+	}
+	toPeerID, _ := msg["toPeerId"].(string)
+	if toPeerID == "" {
+		return errors.New("toPeerId is required")
+	}
+	val, ok := room.Peers.Load(toPeerID)
+	if !ok {
+		return errors.New("target peer is not in the room")
+	}
+	target := val.(*Peer)
+	if !target.host.CompareAndSwap(false, true) {
+		return errors.New("target peer is already host")
+	}
+	peer.host.Store(false)
+
+	s.rooms.Broadcast(room, map[string]interface{}{
+		"type":       "host-changed",
+		"hostId":     target.ID,
+		"previousId": peer.ID,
+	})
+	return nil
+}
+
+// ============================================
+// In-band Streams
+// ============================================
+//
+// Large payloads can be sent over signaling as a stream of small chunks:
+//
+//	sender   -> {"type":"stream-start","streamId":"...","targetId":"..."}
+//	sender   -> {"type":"stream-chunk","streamId":"...","seq":0,"data":"..."}
+//	receiver -> {"type":"stream-ack","streamId":"...","seq":N}
+//	sender   -> {"type":"stream-end","streamId":"..."}
+//
+// Chunks must arrive in seq order, and at most StreamWindow may be unacked.
+// When the window fills the sender gets stream-pause, and stream-resume
+// once the receiver acks, so a slow receiver never backs up the relay.
+// Stream state is per instance.
+
+const maxStreamsPerRoom = 16
+
+var errStreamWindowFull = errors.New("stream window full, wait for stream-resume")
+
+type stream struct {
+	mu     sync.Mutex
+	sender string
+	target string // "" lets any other peer ack
+	next   int64  // seq expected from the sender
+	acked  int64  // chunks the receiver has acknowledged
+	paused bool
+}
+
+func (s *Server) checkStream(room *Room, peer *Peer, msgType string, msg map[string]interface{}) error {
+	streamID, _ := msg["streamId"].(string)
+	if streamID == "" {
+		return errors.New("streamId is required")
+	}
+
+	if msgType == "stream-start" {
+		count := 0
+		room.streams.Range(func(_, _ interface{}) bool {
+			count++
+			return true
 		})
-		if count > 0 {
-			log.Printf("[Relay Cleanup] Removed %d expired files", count)
+		if count >= maxStreamsPerRoom {
+			return fmt.Errorf("too many open streams (max %d)", maxStreamsPerRoom)
+		}
+		target, _ := msg["targetId"].(string)
+		if _, dup := room.streams.LoadOrStore(streamID, &stream{sender: peer.ID, target: target}); dup {
+			return errors.New("streamId already open")
+		}
+		return nil
+	}
+
+	val, ok := room.streams.Load(streamID)
+	if !ok {
+		return errors.New("unknown streamId")
+	}
+	st := val.(*stream)
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	window := int64(s.cfg.StreamWindow)
+
+	switch msgType {
+	case "stream-chunk":
+		if peer.ID != st.sender {
+			return errors.New("only the stream sender may send chunks")
+		}
+		if seq, ok := msg["seq"].(float64); !ok || int64(seq) != st.next {
+			return fmt.Errorf("expected seq %d", st.next)
+		}
+		if data, _ := msg["data"].(string); len(data) > s.cfg.StreamChunkMax {
+			return fmt.Errorf("chunk data exceeds %d bytes", s.cfg.StreamChunkMax)
+		}
+		if st.next-st.acked >= window {
+			return errStreamWindowFull
+		}
+		st.next++
+		if st.next-st.acked >= window && !st.paused {
+			st.paused = true
+			peer.SendJSON(map[string]interface{}{"type": "stream-pause", "streamId": streamID})
+		}
+
+	case "stream-ack":
+		if peer.ID == st.sender || (st.target != "" && peer.ID != st.target) {
+			return errors.New("only the stream receiver may ack")
+		}
+		seq, ok := msg["seq"].(float64)
+		if !ok || int64(seq) < 0 || int64(seq) >= st.next {
+			return errors.New("ack seq out of range")
+		}
+		if int64(seq)+1 > st.acked {
+			st.acked = int64(seq) + 1
+		}
+		if st.paused && st.next-st.acked < window {
+			st.paused = false
+			if val, ok := room.Peers.Load(st.sender); ok {
+				val.(*Peer).SendJSON(map[string]interface{}{"type": "stream-resume", "streamId": streamID})
+			}
+		}
+
+	case "stream-end":
+		if peer.ID != st.sender {
+			return errors.New("only the stream sender may end it")
+		}
+		room.streams.Delete(streamID)
+	}
+	return nil
+}
+
+// dropStreams forgets streams peerID was sending or receiving.
+func (r *Room) dropStreams(peerID string) {
+	r.streams.Range(func(key, value interface{}) bool {
+		if st := value.(*stream); st.sender == peerID || st.target == peerID {
+			r.streams.Delete(key)
+		}
+		return true
+	})
+}
+
+// ============================================
+// Stats Rates (sliding window)
+// ============================================
+
+const rateWindowSize = 60 // seconds of history kept
+
+type rateSample struct {
+	at       time.Time
+	messages int64
+	conns    int64
+	bytes    int64
+}
+
+// rateSampler snapshots the cumulative counters once a second into a ring
+// buffer so /api/stats/rates can report per-second rates directly.
+type rateSampler struct {
+	rm      *RoomManager
+	mu      sync.Mutex
+	samples [rateWindowSize]rateSample
+	next    int
+	filled  int
+}
+
+func newRateSampler(rm *RoomManager) *rateSampler {
+	return &rateSampler{rm: rm}
+}
+
+func (rs *rateSampler) Run() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	rs.sample()
+	for range ticker.C {
+		rs.sample()
+	}
+}
+
+func (rs *rateSampler) sample() {
+	s := rateSample{
+		at:       time.Now(),
+		messages: rs.rm.totalMessages.Load(),
+		conns:    rs.rm.totalConns.Load(),
+		bytes:    rs.rm.totalBytesRelay.Load(),
+	}
+	rs.mu.Lock()
+	rs.samples[rs.next] = s
+	rs.next = (rs.next + 1) % rateWindowSize
+	if rs.filled < rateWindowSize {
+		rs.filled++
+	}
+	rs.mu.Unlock()
+}
+
+// Rates returns per-second rates over the last window seconds.
+func (rs *rateSampler) Rates(window int) (msgs, conns, bytes float64, span time.Duration) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if rs.filled < 2 {
+		return 0, 0, 0, 0
+	}
+	if window >= rs.filled {
+		window = rs.filled - 1
+	}
+	newest := rs.samples[(rs.next-1+rateWindowSize)%rateWindowSize]
+	oldest := rs.samples[(rs.next-1-window+2*rateWindowSize)%rateWindowSize]
+
+	span = newest.at.Sub(oldest.at)
+	secs := span.Seconds()
+	if secs <= 0 {
+		return 0, 0, 0, 0
+	}
+	// A counter that went backwards was reset; report zero rather than negative
+	perSec := func(a, b int64) float64 {
+		if b < a {
+			return 0
+		}
+		return float64(b-a) / secs
+	}
+	return perSec(oldest.messages, newest.messages),
+		perSec(oldest.conns, newest.conns),
+		perSec(oldest.bytes, newest.bytes),
+		span
+}
+
+// ============================================
+// HTTP Handlers
+// ============================================
+
+// clientIP returns the remote address without its port, so per-IP limits
+// apply to the host rather than to each TCP connection.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	// "/" is ServeMux's catch-all; only the exact root is the health check
+	if r.URL.Path != "/" {
+		s.handleNotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.cfg.brand(map[string]interface{}{
+		"status":  "ok",
+		"version": version,
+	}))
+}
+
+// handleNotFound answers unmatched routes with a JSON 404.
+func (s *Server) handleNotFound(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusNotFound)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": "Not found",
+		"path":  r.URL.Path,
+	})
+}
+
+// brand adds the configured server name (and support URL, if any) to resp.
+func (c *Config) brand(resp map[string]interface{}) map[string]interface{} {
+	resp["server"] = c.ServerName
+	if c.SupportURL != "" {
+		resp["supportUrl"] = c.SupportURL
+	}
+	return resp
+}
+
+// handleReady serves GET /api/ready for load balancers: 503 while in
+// maintenance or while storage writes are failing, so traffic moves to
+// other instances.
+func (s *Server) handleReady(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if s.relay.breaker.Open() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status":  "storage-unavailable",
+			"message": "Storage write breaker is open",
+			"peers":   s.rooms.LocalPeerCount(),
+		})
+		return
+	}
+	if msg := s.maintenance.Load(); msg != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status":  "maintenance",
+			"message": *msg,
+			"peers":   s.rooms.LocalPeerCount(),
+		})
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status": "ready",
+		"peers":  s.rooms.LocalPeerCount(),
+	})
+}
+
+func (s *Server) handleVersion(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.cfg.brand(map[string]interface{}{
+		"version":   version,
+		"gitCommit": gitCommit,
+		"buildTime": buildTime,
+		"goVersion": runtime.Version(),
+	}))
+}
+
+// capabilities describes the features and limits this server runs with,
+// so clients can adapt instead of probing. Served by /api/capabilities and
+// the get-capabilities signaling message.
+func (s *Server) capabilities() map[string]interface{} {
+	joinSig := ""
+	switch {
+	case len(s.cfg.JoinEd25519Key) > 0:
+		joinSig = "ed25519"
+	case len(s.cfg.JoinHMACKey) > 0:
+		joinSig = "hmac-sha256"
+	}
+	return s.cfg.brand(map[string]interface{}{
+		"version": version,
+		"rooms": map[string]interface{}{
+			"codeLength":       s.cfg.RoomCodeLength,
+			"codeAlphabet":     roomCodeChars,
+			"vanityCodes":      true,
+			"maxPeersPerRoom":  s.cfg.MaxPeersPerRoom,
+			"groupMode":        s.cfg.MaxPeersPerRoom > 2,
+			"guestCreatesRoom": s.cfg.GuestCreatesRoom,
+			"timeoutSeconds":   s.cfg.RoomTimeout.Seconds(),
+		},
+		"signaling": map[string]interface{}{
+			"subprotocols":      []string{batchSubprotocol, dictSubprotocol},
+			"permessageDeflate": s.cfg.WSCompression,
+			"maxMessageSize":    s.cfg.MaxMessageSize,
+			"maxMsgPerSecond":   s.cfg.MaxMsgPerSecond,
+			"streamWindow":      s.cfg.StreamWindow,
+			"streamChunkMax":    s.cfg.StreamChunkMax,
+			"stampMessages":     s.cfg.StampMessages,
+			"absentTarget":      s.cfg.AbsentTarget,
+			"msgTypeLimits":     s.cfg.MsgTypeLimits,
+			"helloRequired":     s.cfg.RequireHello,
+			"joinSignature":     joinSig,
+			"controlMessages": []string{
+				"request-relay", "get-peers", "get-conn-stats", "get-capabilities",
+				"renegotiate", "transfer-offer", "transfer-accept", "transfer-reject",
+				"transfer-host", "close-room", "adopt-file", "stream-start", "stream-chunk", "stream-ack", "stream-end",
+			},
+		},
+		"relay": map[string]interface{}{
+			"enabled":         true,
+			"maxFileSize":     s.cfg.MaxFileSize,
+			"chunkSize":       s.cfg.ChunkSize,
+			"compression":     []string{"lz4"},
+			"fileTtlSeconds":  s.cfg.RelayFileTTL.Seconds(),
+			"rawUpload":       true,
+			"zipDownload":     true,
+			"rangeRequests":   true,
+			"checksums":       []string{"sha256"},
+			"signedDownloads": len(s.cfg.DownloadSecret) > 0,
+		},
+	})
+}
+
+func (s *Server) handleCapabilities(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.capabilities())
+}
+
+// handleWSDictionary serves the preset dictionary for dictSubprotocol, so
+// clients can check theirs against it.
+func (s *Server) handleWSDictionary(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("X-Subprotocol", dictSubprotocol)
+	w.Write(signalingDict)
+}
+
+func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"activeRooms":      s.rooms.RoomCount(),
+		"totalConnections": s.rooms.totalConns.Load(),
+		"totalMessages":    s.rooms.totalMessages.Load(),
+		"totalBytesRelay":  s.rooms.totalBytesRelay.Load(),
+		"uptimeSeconds":    time.Since(s.rooms.startTime).Seconds(),
+		"wsCompression":    s.rooms.deflateStats(),
+		"roomLifetime":     s.rooms.lifetimes.stats(),
+	})
+}
+
+// handleStatsRates serves GET /api/stats/rates?window=N (seconds, default 10).
+func (s *Server) handleStatsRates(w http.ResponseWriter, r *http.Request) {
+	window := 10
+	if v, err := strconv.Atoi(r.URL.Query().Get("window")); err == nil && v > 0 && v < rateWindowSize {
+		window = v
+	}
+	msgs, conns, bytes, span := s.rates.Rates(window)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"messagesPerSecond":    msgs,
+		"connectionsPerSecond": conns,
+		"bytesPerSecond":       bytes,
+		"windowSeconds":        span.Seconds(),
+	})
+}
+
+// createRoomRequest is the optional body of POST /api/rooms.
+type createRoomRequest struct {
+	Code           string `json:"code,omitempty"`
+	MaxMessageSize int64  `json:"maxMessageSize,omitempty"`
+}
+
+func (s *Server) handleCreateRoom(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if msg := s.maintenance.Load(); msg != nil {
+		http.Error(w, *msg, http.StatusServiceUnavailable)
+		return
+	}
+
+	// An optional {"code":"..."} asks for a vanity code; without one a
+	// random code is generated. maxMessageSize overrides the per-message
+	// read limit for the room, up to the server's MaxMessageSize.
+	var req createRoomRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 4096)).Decode(&req); err != nil && err != io.EOF {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	if req.MaxMessageSize < 0 || req.MaxMessageSize > s.cfg.MaxMessageSize {
+		http.Error(w, fmt.Sprintf("maxMessageSize must be between 0 (server default) and %d", s.cfg.MaxMessageSize), http.StatusBadRequest)
+		return
+	}
+
+	var code string
+	if req.Code == "" {
+		var ok bool
+		if code, ok = s.rooms.CreateRoom(clientIP(r), req.MaxMessageSize); !ok {
+			http.Error(w, "Too many rooms", http.StatusTooManyRequests)
+			return
+		}
+	} else {
+		var ok bool
+		if code, ok = s.rooms.NormalizeCode(req.Code); !ok {
+			http.Error(w, fmt.Sprintf("Room code must be %d characters from %s",
+				s.cfg.RoomCodeLength, roomCodeChars), http.StatusBadRequest)
+			return
+		}
+		if s.rooms.Reserved(code) {
+			http.Error(w, "Room code is reserved", http.StatusForbidden)
+			return
+		}
+		switch err := s.rooms.ClaimRoom(clientIP(r), code, req.MaxMessageSize); err {
+		case nil:
+		case errRoomTaken:
+			http.Error(w, "Room code already in use", http.StatusConflict)
+			return
+		default:
+			http.Error(w, "Too many rooms", http.StatusTooManyRequests)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"roomCode": code,
+		"created":  true,
+	})
+}
+
+func (s *Server) handleGetRoom(w http.ResponseWriter, r *http.Request) {
+	codePart, sub, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/rooms/"), "/")
+	code, ok := s.rooms.NormalizeCode(codePart)
+	if !ok {
+		http.Error(w, "Invalid room code", http.StatusBadRequest)
+		return
+	}
+	room := s.rooms.GetRoom(code)
+	if room == nil {
+		http.Error(w, "Room not found", http.StatusNotFound)
+		return
+	}
+
+	switch sub {
+	case "":
+	case "join-info":
+		s.handleJoinInfo(w, r, room)
+		return
+	case "kv":
+		s.handleRoomKV(w, r, room)
+		return
+	default:
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"code":      room.Code,
+		"peerCount": room.PeerCount(),
+		"createdAt": room.CreatedAt.Unix(),
+	})
+}
+
+// BaseURL returns SENDIT_PUBLIC_URL, or else the scheme://host clients
+// reached us on, honouring X-Forwarded-Proto from a TLS-terminating proxy.
+func (c *Config) BaseURL(r *http.Request) string {
+	if c.PublicURL != "" {
+		return c.PublicURL
+	}
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+// WSBaseURL is BaseURL with the matching ws:// or wss:// scheme.
+func (c *Config) WSBaseURL(r *http.Request) string {
+	u := c.BaseURL(r)
+	if strings.HasPrefix(u, "https://") {
+		return "wss://" + strings.TrimPrefix(u, "https://")
+	}
+	return "ws://" + strings.TrimPrefix(u, "http://")
+}
+
+const (
+	maxRoomKVKeys     = 64
+	maxRoomKVKeyLen   = 128
+	maxRoomKVBytes    = 64 * 1024 // keys plus values, per room
+	maxRoomKVBodySize = maxRoomKVBytes + 4096
+)
+
+// handleRoomKV serves /api/rooms/{code}/kv, a small key-value store that
+// lives as long as the room, for state peers must share even before both
+// are connected. GET returns the whole map; POST merges a JSON object into
+// it, where a null value deletes the key. Only kept on this instance.
+func (s *Server) handleRoomKV(w http.ResponseWriter, r *http.Request, room *Room) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var update map[string]json.RawMessage
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRoomKVBodySize)).Decode(&update); err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				http.Error(w, "Body too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			http.Error(w, "Body must be a JSON object", http.StatusBadRequest)
+			return
+		}
+		if err := room.updateKV(update); err != nil {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	room.kvMu.Lock()
+	data, err := json.Marshal(room.kv)
+	room.kvMu.Unlock()
+	if err != nil {
+		http.Error(w, "Encoding error", http.StatusInternalServerError)
+		return
+	}
+	if string(data) == "null" {
+		data = []byte("{}")
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// updateKV applies update to the room's store, all or nothing, keeping it
+// within the key count and size bounds.
+func (r *Room) updateKV(update map[string]json.RawMessage) error {
+	r.kvMu.Lock()
+	defer r.kvMu.Unlock()
+
+	keys, size := len(r.kv), r.kvBytes
+	for key, value := range update {
+		if key == "" || len(key) > maxRoomKVKeyLen {
+			return fmt.Errorf("keys must be 1-%d bytes", maxRoomKVKeyLen)
+		}
+		if old, ok := r.kv[key]; ok {
+			keys--
+			size -= len(key) + len(old)
+		}
+		if string(value) != "null" {
+			keys++
+			size += len(key) + len(value)
+		}
+	}
+	if keys > maxRoomKVKeys {
+		return fmt.Errorf("at most %d keys per room", maxRoomKVKeys)
+	}
+	if size > maxRoomKVBytes {
+		return fmt.Errorf("at most %d bytes of keys and values per room", maxRoomKVBytes)
+	}
+
+	if r.kv == nil {
+		r.kv = make(map[string]json.RawMessage)
+	}
+	for key, value := range update {
+		if string(value) == "null" {
+			delete(r.kv, key)
+		} else {
+			r.kv[key] = value
+		}
+	}
+	r.kvBytes = size
+	return nil
+}
+
+// handleQuickSend serves POST /api/quick-send for headless senders: one
+// call creates a room and a single-use upload ticket scoped to it, so a
+// script can upload and share the code without opening a WebSocket.
+func (s *Server) handleQuickSend(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if msg := s.maintenance.Load(); msg != nil {
+		http.Error(w, *msg, http.StatusServiceUnavailable)
+		return
+	}
+	code, ok := s.rooms.CreateRoom(clientIP(r), 0)
+	if !ok {
+		http.Error(w, "Too many rooms", http.StatusTooManyRequests)
+		return
+	}
+	ticket := s.relay.IssueTicket(code)
+	base := s.cfg.BaseURL(r)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"roomCode":     code,
+		"wsUrl":        fmt.Sprintf("%s/ws/%s", s.cfg.WSBaseURL(r), code),
+		"uploadToken":  ticket.Token,
+		"uploadUrl":    fmt.Sprintf("%s/api/relay/upload?token=%s", base, ticket.Token),
+		"rawUploadUrl": fmt.Sprintf("%s/api/relay/upload/raw?token=%s", base, ticket.Token),
+		"expiresAt":    ticket.ExpiresAt.Unix(),
+		"maxFileSize":  s.cfg.MaxFileSize,
+	})
+}
+
+// handleJoinInfo serves GET /api/rooms/{code}/join-info with the full
+// WebSocket join URL and, with ?qr=true, a base64 PNG QR code of it.
+func (s *Server) handleJoinInfo(w http.ResponseWriter, r *http.Request, room *Room) {
+	joinURL := fmt.Sprintf("%s/ws/%s", s.cfg.WSBaseURL(r), room.Code)
+
+	resp := map[string]interface{}{
+		"roomCode": room.Code,
+		"wsUrl":    joinURL,
+	}
+	if r.URL.Query().Get("qr") == "true" {
+		png, err := qrcode.Encode(joinURL, qrcode.Medium, 256)
+		if err != nil {
+			http.Error(w, "QR generation failed", http.StatusInternalServerError)
+			return
 		}
+		resp["qrCode"] = base64.StdEncoding.EncodeToString(png)
 	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
 }
 
 // ============================================
-// WebSocket Handler
+// Server
 // ============================================
 
-var upgrader = websocket.Upgrader{
-	ReadBufferSize:  16 * 1024,
-	WriteBufferSize: 16 * 1024,
-	CheckOrigin:     func(r *http.Request) bool { return true },
+// Server owns one isolated instance of the signaling and relay state, so
+// tests can run several side by side behind httptest.
+type Server struct {
+	cfg   *Config
+	rooms *RoomManager
+	relay *FileRelay
+	rates *rateSampler
+	admit *admission
+
+	// maintenance holds the message shown to rejected clients while new
+	// rooms and connections are refused; nil when serving normally.
+	maintenance atomic.Pointer[string]
 }
 
-var roomMgr = NewRoomManager()
-var fileRelay = NewFileRelay()
+func NewServer(cfg *Config) (*Server, error) {
+	rooms, err := NewRoomManager(cfg)
+	if err != nil {
+		return nil, err
+	}
+	relay, err := NewFileRelay(cfg, rooms)
+	if err != nil {
+		return nil, err
+	}
+	return &Server{
+		cfg:   cfg,
+		rooms: rooms,
+		relay: relay,
+		rates: newRateSampler(rooms),
+		admit: newAdmission(cfg.MaxPeers, cfg.AdmissionQueue),
+	}, nil
+}
 
-func handleWebSocket(w http.ResponseWriter, r *http.Request) {
-	// Extract room code from path: /ws/{roomCode}
-	pathParts := strings.Split(strings.TrimPrefix(r.URL.Path, "/ws/"), "/")
-	if len(pathParts) == 0 || pathParts[0] == "" {
-		http.Error(w, "Room code required", http.StatusBadRequest)
-		return
+// Start launches the background cleanup, sampling and cluster loops.
+func (s *Server) Start() {
+	go s.rooms.CleanupLoop()
+	go s.relay.CleanupLoop()
+	go s.rates.Run()
+	if s.rooms.cluster != nil {
+		go s.rooms.cluster.Run()
 	}
-	roomCode := strings.ToUpper(pathParts[0])
+}
 
-	peerID := r.URL.Query().Get("peer_id")
-	isHost := r.URL.Query().Get("is_host") == "true"
-	clientIP := r.RemoteAddr
+// Handler returns the fully wrapped (CORS + gzip) HTTP handler.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
 
-	if !roomMgr.CheckIPLimit(clientIP) {
-		http.Error(w, "Too many connections", http.StatusTooManyRequests)
-		return
-	}
+	// Health & Stats
+	mux.HandleFunc("/", s.handleHealth)
+	mux.HandleFunc("/api/stats", s.handleStats)
+	mux.HandleFunc("/api/stats/rates", s.handleStatsRates)
+	mux.HandleFunc("/api/version", s.handleVersion)
+	mux.HandleFunc("/api/capabilities", s.handleCapabilities)
+	mux.HandleFunc("/api/ws-dictionary", s.handleWSDictionary)
+	mux.HandleFunc("/api/schema", s.handleSchema)
+	mux.HandleFunc("/api/ready", s.handleReady)
 
-	conn, err := upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		log.Printf("[WS] Upgrade error: %v", err)
-		return
-	}
-	defer conn.Close()
+	// Room management
+	mux.HandleFunc("/api/rooms", s.handleCreateRoom)
+	mux.HandleFunc("/api/rooms/", s.handleGetRoom)
+	mux.HandleFunc("/api/quick-send", s.handleQuickSend)
 
-	// Get or create room
-	room := roomMgr.GetRoom(roomCode)
-	if room == nil {
-		if isHost {
-			roomMgr.rooms.Store(roomCode, NewRoom(roomCode))
-			room = roomMgr.GetRoom(roomCode)
-		} else {
-			conn.WriteJSON(map[string]string{
-				"type":    "error",
-				"message": "Room not found",
-			})
-			return
-		}
-	}
+	// WebSocket signaling
+	mux.HandleFunc("/ws/", s.handleWebSocket)
 
-	if room.PeerCount() >= cfg.MaxPeersPerRoom {
-		conn.WriteJSON(map[string]string{
-			"type":    "error",
-			"message": "Room is full",
-		})
-		return
-	}
+	// File relay
+	mux.HandleFunc("/api/relay/upload", s.relay.Upload)
+	mux.HandleFunc("/api/relay/upload/raw", s.relay.UploadRaw)
+	mux.HandleFunc("/api/relay/download/", s.relay.Download)
+	mux.HandleFunc("/api/relay/download-zip", s.relay.DownloadZip)
 
-	if peerID == "" {
-		b := make([]byte, 8)
-		rand.Read(b)
-		peerID = hex.EncodeToString(b)
+	// Admin
+	mux.HandleFunc("/api/admin/rooms", s.requireAdmin(s.handleAdminRooms))
+	mux.HandleFunc("/api/admin/rooms/", s.requireAdmin(s.handleAdminRoom))
+	mux.HandleFunc("/api/admin/maintenance", s.requireAdmin(s.handleAdminMaintenance))
+	mux.HandleFunc("/api/admin/broadcast", s.requireAdmin(s.handleAdminBroadcast))
+	mux.HandleFunc("/api/admin/debug", s.requireAdmin(s.handleAdminDebug))
+	if s.cfg.Pprof {
+		// pprof.Index resolves profiles under /debug/pprof/, so strip our prefix
+		prof := http.NewServeMux()
+		prof.HandleFunc("/debug/pprof/", pprof.Index)
+		prof.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		prof.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		prof.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		prof.HandleFunc("/debug/pprof/trace", pprof.Trace)
+		mux.HandleFunc("/api/admin/debug/pprof/", s.requireAdmin(http.StripPrefix("/api/admin", prof).ServeHTTP))
 	}
 
-	peer := &Peer{
-		ID:          peerID,
-		Conn:        conn,
-		IsHost:      isHost,
-		RoomCode:    roomCode,
-		IP:          clientIP,
-		ConnectedAt: time.Now(),
-	}
+	// CORS
+	handler := cors.New(cors.Options{
+		AllowedOrigins:   []string{"*"},
+		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
+		AllowedHeaders:   []string{"*"},
+		AllowCredentials: true,
+	}).Handler(recoverPanics(mux))
 
-	roomMgr.AddPeer(room, peer)
-	defer func() {
-		if r := roomMgr.GetRoom(roomCode); r != nil {
-			roomMgr.RemovePeer(r, peerID)
-		}
-	}()
+	// Gzip middleware wrapper
+	handler = gzipMiddleware(handler, s.cfg.GzipLevel, s.cfg.GzipMinSize, s.cfg.GzipTypes)
+	return apiWriteTimeout(handler, s.cfg.APIWriteTimeout)
+}
 
-	// Read loop
-	conn.SetReadLimit(16 * 1024 * 1024) // 16MB max message
-	conn.SetReadDeadline(time.Now().Add(60 * time.Second))
-	conn.SetPongHandler(func(string) error {
-		conn.SetReadDeadline(time.Now().Add(60 * time.Second))
-		return nil
-	})
+// ============================================
+// Admin API
+// ============================================
 
-	// Ping loop
-	go func() {
-		ticker := time.NewTicker(25 * time.Second)
-		defer ticker.Stop()
-		for range ticker.C {
-			peer.mu.Lock()
-			err := conn.WriteMessage(websocket.PingMessage, nil)
-			peer.mu.Unlock()
-			if err != nil {
-				return
-			}
+// requireAdmin guards next with SENDIT_GO_ADMIN_TOKEN as a bearer token.
+// With no token configured the admin API does not exist.
+func (s *Server) requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.cfg.AdminToken == "" {
+			http.NotFound(w, r)
+			return
 		}
-	}()
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(s.cfg.AdminToken)) != 1 {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
 
-	for {
-		_, msgBytes, err := conn.ReadMessage()
-		if err != nil {
-			break
+const (
+	defaultRoomListLimit = 1000
+	roomListTimeout      = 5 * time.Second
+)
+
+// handleAdminRooms serves GET /api/admin/rooms?limit=N as a JSON array
+// streamed one room at a time, so a server with tens of thousands of rooms
+// never builds the whole list in memory. The walk stops at limit rooms or
+// after roomListTimeout; a cut-short list sets the X-Truncated trailer.
+func (s *Server) handleAdminRooms(w http.ResponseWriter, r *http.Request) {
+	limit := defaultRoomListLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
 		}
-		conn.SetReadDeadline(time.Now().Add(60 * time.Second))
+		limit = min(n, s.cfg.MaxRooms)
+	}
+	deadline := time.Now().Add(roomListTimeout)
 
-		var msg map[string]interface{}
-		if err := json.Unmarshal(msgBytes, &msg); err != nil {
-			continue
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Trailer", "X-Truncated")
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+
+	io.WriteString(w, "[")
+	n, truncated := 0, false
+	s.rooms.rooms.Range(func(_, value interface{}) bool {
+		if n >= limit || time.Now().After(deadline) || r.Context().Err() != nil {
+			truncated = true
+			return false
+		}
+		room := value.(*Room)
+		if n > 0 {
+			io.WriteString(w, ",")
+		}
+		enc.Encode(map[string]interface{}{
+			"code":         room.Code,
+			"peerCount":    room.PeerCount(),
+			"createdAt":    room.CreatedAt.Unix(),
+			"messageCount": room.MessageCount.Load(),
+		})
+		n++
+		if n%100 == 0 && flusher != nil {
+			flusher.Flush()
 		}
+		return true
+	})
+	io.WriteString(w, "]")
+	w.Header().Set("X-Truncated", strconv.FormatBool(truncated))
+}
 
-		roomMgr.RelayMessage(room, peerID, msg)
+// handleAdminRoom serves GET /api/admin/rooms/{code} with per-peer traffic
+// counters for the peers connected to this instance.
+func (s *Server) handleAdminRoom(w http.ResponseWriter, r *http.Request) {
+	code, ok := s.rooms.NormalizeCode(strings.TrimPrefix(r.URL.Path, "/api/admin/rooms/"))
+	if !ok {
+		http.Error(w, "Invalid room code", http.StatusBadRequest)
+		return
+	}
+	room := s.rooms.GetRoom(code)
+	if room == nil {
+		http.Error(w, "Room not found", http.StatusNotFound)
+		return
 	}
-}
 
-// ============================================
-// HTTP Handlers
-// ============================================
+	peers := []map[string]interface{}{}
+	room.Peers.Range(func(_, value interface{}) bool {
+		peers = append(peers, value.(*Peer).Stats())
+		return true
+	})
 
-func handleHealth(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
-		"status":  "ok",
-		"server":  "SendIt-Go",
-		"version": "2.0.0",
+		"code":         room.Code,
+		"createdAt":    room.CreatedAt.Unix(),
+		"messageCount": room.MessageCount.Load(),
+		"peers":        peers,
 	})
 }
 
-func handleStats(w http.ResponseWriter, r *http.Request) {
+// handleAdminDebug serves GET /api/admin/debug: goroutines, heap and GC
+// figures, live counts and buffer pool reuse. Cheap enough to poll, unlike
+// a pprof profile.
+func (s *Server) handleAdminDebug(w http.ResponseWriter, r *http.Request) {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	gets, allocs := s.relay.bufs.gets.Load(), s.relay.bufs.allocs.Load()
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
-		"activeRooms":      roomMgr.RoomCount(),
-		"totalConnections": roomMgr.totalConns.Load(),
-		"totalMessages":    roomMgr.totalMessages.Load(),
-		"totalBytesRelay":  roomMgr.totalBytesRelay.Load(),
-		"uptimeSeconds":    time.Since(roomMgr.startTime).Seconds(),
+		"goroutines": runtime.NumGoroutine(),
+		"memory": map[string]interface{}{
+			"heapAlloc":    mem.HeapAlloc,
+			"heapInuse":    mem.HeapInuse,
+			"heapObjects":  mem.HeapObjects,
+			"sys":          mem.Sys,
+			"totalAlloc":   mem.TotalAlloc,
+			"numGC":        mem.NumGC,
+			"pauseTotalNs": mem.PauseTotalNs,
+			"lastGC":       time.Unix(0, int64(mem.LastGC)).Unix(),
+		},
+		"rooms":       s.rooms.RoomCount(),
+		"peers":       s.rooms.LocalPeerCount(),
+		"maintenance": s.maintenance.Load() != nil,
+		"bufferPool": map[string]interface{}{
+			"gets":   gets,
+			"allocs": allocs,
+			"hits":   gets - allocs,
+		},
+		"pprof": s.cfg.Pprof,
 	})
 }
 
-func handleCreateRoom(w http.ResponseWriter, r *http.Request) {
+const (
+	broadcastWorkers = 64
+	broadcastWait    = 2 * time.Second
+)
+
+type broadcastRequest struct {
+	Message string `json:"message"`
+}
+
+// handleAdminBroadcast serves POST /api/admin/broadcast {"message":"..."},
+// sending {"type":"announcement"} to every peer on this instance. Sends
+// run on a worker pool; the response waits at most broadcastWait, so a
+// slow peer delays neither other peers nor the caller. Peers still being
+// written to when it returns are reported as pending.
+func (s *Server) handleAdminBroadcast(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
-	code := roomMgr.CreateRoom()
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"roomCode": code,
-		"created":  true,
+	var req broadcastRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 64*1024)).Decode(&req); err != nil || req.Message == "" {
+		http.Error(w, "JSON body with a message is required", http.StatusBadRequest)
+		return
+	}
+
+	var peers []*Peer
+	s.rooms.rooms.Range(func(_, value interface{}) bool {
+		value.(*Room).Peers.Range(func(_, p interface{}) bool {
+			peers = append(peers, p.(*Peer))
+			return true
+		})
+		return true
 	})
-}
 
-func handleGetRoom(w http.ResponseWriter, r *http.Request) {
-	code := strings.TrimPrefix(r.URL.Path, "/api/rooms/")
-	room := roomMgr.GetRoom(code)
-	if room == nil {
-		http.Error(w, "Room not found", http.StatusNotFound)
-		return
+	announcement := s.cfg.brand(map[string]interface{}{
+		"type":    "announcement",
+		"message": req.Message,
+	})
+	var delivered, failed atomic.Int64
+	jobs := make(chan *Peer)
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < min(broadcastWorkers, len(peers)); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for p := range jobs {
+				if p.SendJSON(announcement) == nil {
+					delivered.Add(1)
+				} else {
+					failed.Add(1)
+				}
+			}
+		}()
+	}
+	go func() {
+		for _, p := range peers {
+			jobs <- p
+		}
+		close(jobs)
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(broadcastWait):
 	}
+	log.Printf("[Admin] Broadcast to %d peers: %s", len(peers), req.Message)
+
+	d, f := delivered.Load(), failed.Load()
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
-		"code":      room.Code,
-		"peerCount": room.PeerCount(),
-		"createdAt": room.CreatedAt.Unix(),
+		"peers":     len(peers),
+		"delivered": d,
+		"failed":    f,
+		"pending":   int64(len(peers)) - d - f,
 	})
 }
 
-// ============================================
-// Main
-// ============================================
-
-func main() {
-	mux := http.NewServeMux()
+const defaultMaintenanceMessage = "Server is under maintenance, try again shortly"
 
-	// Health & Stats
-	mux.HandleFunc("/", handleHealth)
-	mux.HandleFunc("/api/stats", handleStats)
+type maintenanceRequest struct {
+	Enabled bool   `json:"enabled"`
+	Message string `json:"message,omitempty"`
+}
 
-	// Room management
-	mux.HandleFunc("/api/rooms", handleCreateRoom)
-	mux.HandleFunc("/api/rooms/", handleGetRoom)
+// handleAdminMaintenance reports (GET) or sets (POST {"enabled":bool,
+// "message":"..."}) maintenance mode. Existing peers keep signaling; only
+// new connections and room creation are refused.
+func (s *Server) handleAdminMaintenance(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var req maintenanceRequest
+		if err := json.NewDecoder(io.LimitReader(r.Body, 64*1024)).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		s.SetMaintenance(req.Enabled, req.Message)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
 
-	// WebSocket signaling
-	mux.HandleFunc("/ws/", handleWebSocket)
+	resp := map[string]interface{}{"enabled": false}
+	if msg := s.maintenance.Load(); msg != nil {
+		resp = map[string]interface{}{"enabled": true, "message": *msg}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
 
-	// File relay
-	mux.HandleFunc("/api/relay/upload", fileRelay.Upload)
-	mux.HandleFunc("/api/relay/download/", fileRelay.Download)
+// SetMaintenance switches maintenance mode on (with message, or a default)
+// or off.
+func (s *Server) SetMaintenance(enabled bool, message string) {
+	if !enabled {
+		s.maintenance.Store(nil)
+		log.Printf("[Admin] Maintenance mode off")
+		return
+	}
+	if message == "" {
+		message = defaultMaintenanceMessage
+	}
+	s.maintenance.Store(&message)
+	log.Printf("[Admin] Maintenance mode on: %s", message)
+}
 
-	// CORS
-	handler := cors.New(cors.Options{
-		AllowedOrigins:   []string{"*"},
-		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowedHeaders:   []string{"*"},
-		AllowCredentials: true,
-	}).Handler(mux)
+// Drain enters maintenance and waits up to timeout for this instance's
+// peers to disconnect on their own.
+func (s *Server) Drain(timeout time.Duration) {
+	if timeout <= 0 {
+		return
+	}
+	if s.maintenance.Load() == nil {
+		s.SetMaintenance(true, "Server is restarting")
+	}
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		n := s.rooms.LocalPeerCount()
+		if n == 0 {
+			return
+		}
+		log.Printf("[Drain] Waiting for %d peers", n)
+		time.Sleep(time.Second)
+	}
+}
 
-	// Gzip middleware wrapper
-	gzHandler := gzipMiddleware(handler)
+// ============================================
+// Main
+// ============================================
 
-	// Start cleanup goroutines
-	go roomMgr.CleanupLoop()
-	go fileRelay.CleanupLoop()
+func main() {
+	cfg := NewConfig()
+	if err := cfg.Validate(); err != nil {
+		log.Fatalf("Invalid configuration:\n%v", err)
+	}
+	srv, err := NewServer(cfg)
+	if err != nil {
+		log.Fatalf("Startup failed: %v", err)
+	}
+	srv.Start()
 
 	addr := fmt.Sprintf("%s:%d", cfg.Host, cfg.Port)
 	server := &http.Server{
 		Addr:           addr,
-		Handler:        gzHandler,
+		Handler:        srv.Handler(),
 		ReadTimeout:    30 * time.Second,
 		WriteTimeout:   0, // No timeout for streaming
 		MaxHeaderBytes: 1 << 20,
+		// A short header deadline stops slowloris clients holding sockets
+		// open; IdleTimeout only runs between keep-alive requests, so it
+		// never cuts off a download in progress
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
 	}
 
 	// Graceful shutdown
@@ -789,6 +5452,8 @@ func main() {
 		signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
 		<-sigCh
 		log.Println("Shutting down...")
+		srv.Drain(cfg.DrainTimeout)
+		srv.relay.DrainUploads(cfg.UploadGrace)
 		server.Close()
 	}()
 
@@ -801,11 +5466,65 @@ func main() {
 	}
 }
 
+// ============================================
+// Panic Recovery Middleware
+// ============================================
+
+// recoverPanics answers a panicking handler with a logged 500 instead of
+// net/http's dropped connection. It sits inside the gzip and CORS wrappers
+// so their deferred writes don't commit a 200 first. WebSocket handlers
+// recover on their own goroutines, see logPanic.
+func recoverPanics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			if v == http.ErrAbortHandler {
+				panic(v) // a deliberate abort, not a bug
+			}
+			log.Printf("[HTTP] Panic serving %s %s: %v\n%s", r.Method, r.URL.Path, v, debug.Stack())
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ============================================
+// Write Timeout Middleware
+// ============================================
+
+// apiWriteTimeout gives ordinary API responses a write deadline. Paths that
+// legitimately run long are left alone: WebSockets, relay transfers (see
+// FileRelay.watchdog) and pprof captures.
+func apiWriteTimeout(next http.Handler, timeout time.Duration) http.Handler {
+	if timeout <= 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/ws/") &&
+			!strings.HasPrefix(r.URL.Path, "/api/relay/") &&
+			!strings.HasPrefix(r.URL.Path, "/api/admin/debug/pprof/") {
+			http.NewResponseController(w).SetWriteDeadline(time.Now().Add(timeout))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
 // ============================================
 // Gzip Middleware
 // ============================================
 
-func gzipMiddleware(next http.Handler) http.Handler {
+func gzipMiddleware(next http.Handler, level, minSize int, types []string) http.Handler {
+	// Writers are pooled and Reset per request; level is validated in config
+	pool := &sync.Pool{
+		New: func() interface{} {
+			gz, _ := gzip.NewWriterLevel(io.Discard, level)
+			return gz
+		},
+	}
+
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
 			next.ServeHTTP(w, r)
@@ -813,25 +5532,154 @@ func gzipMiddleware(next http.Handler) http.Handler {
 		}
 		// Skip for WebSocket and file downloads
 		if strings.HasPrefix(r.URL.Path, "/ws/") ||
-			strings.HasPrefix(r.URL.Path, "/api/relay/download/") {
+			strings.HasPrefix(r.URL.Path, "/api/relay/download/") ||
+			r.URL.Path == "/api/relay/download-zip" {
 			next.ServeHTTP(w, r)
 			return
 		}
 
-		w.Header().Set("Content-Encoding", "gzip")
-		gz := gzip.NewWriter(w)
-		defer gz.Close()
-
-		gzw := &gzipResponseWriter{Writer: gz, ResponseWriter: w}
+		gzw := &gzipResponseWriter{
+			ResponseWriter: w,
+			pool:           pool,
+			minSize:        minSize,
+			types:          types,
+			status:         http.StatusOK,
+			path:           r.URL.Path,
+		}
+		defer gzw.Close()
 		next.ServeHTTP(gzw, r)
 	})
 }
 
+// gzipResponseWriter holds back the first minSize bytes of a response, then
+// compresses only if the body turned out large enough and its Content-Type
+// is in the allowlist. Small bodies go out as-is, since gzip framing would
+// make them bigger.
 type gzipResponseWriter struct {
-	io.Writer
 	http.ResponseWriter
+	pool    *sync.Pool
+	gz      *gzip.Writer
+	minSize int
+	types   []string
+	buf     []byte
+	status  int
+	decided bool
+	path    string
+	err     error // first write error once compressing; later writes are dropped
+}
+
+func (w *gzipResponseWriter) WriteHeader(status int) {
+	if !w.decided {
+		w.status = status
+		return
+	}
+	w.ResponseWriter.WriteHeader(status)
 }
 
 func (w *gzipResponseWriter) Write(b []byte) (int, error) {
-	return w.Writer.Write(b)
+	if !w.decided {
+		w.buf = append(w.buf, b...)
+		if len(w.buf) < w.minSize {
+			return len(b), nil
+		}
+		if err := w.decide(true); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+	if w.err != nil {
+		return 0, w.err
+	}
+	if w.gz != nil {
+		n, err := w.gz.Write(b)
+		if err != nil {
+			w.fail(err)
+		}
+		return n, err
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// fail records a mid-stream gzip error. Headers are already out, so there
+// is no switching to identity; the body is cut short without a gzip
+// trailer, which clients reject as truncated rather than misreading.
+func (w *gzipResponseWriter) fail(err error) {
+	w.err = err
+	log.Printf("[Gzip] Write failed for %s, abandoning response: %v", w.path, err)
+}
+
+// decide sends the headers and buffered bytes, gzipped when large is set
+// and the content type allows it.
+func (w *gzipResponseWriter) decide(large bool) error {
+	w.decided = true
+	h := w.Header()
+	if h.Get("Content-Type") == "" && len(w.buf) > 0 {
+		h.Set("Content-Type", http.DetectContentType(w.buf))
+	}
+	if large && h.Get("Content-Encoding") == "" && w.compressible(h.Get("Content-Type")) {
+		// Nothing is committed yet, so a writer the pool could not build
+		// just means this response goes out uncompressed
+		if gz, ok := w.pool.Get().(*gzip.Writer); ok && gz != nil {
+			h.Set("Content-Encoding", "gzip")
+			h.Add("Vary", "Accept-Encoding")
+			h.Del("Content-Length")
+			w.gz = gz
+			w.gz.Reset(w.ResponseWriter)
+		}
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+	buf := w.buf
+	w.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	_, err := w.Write(buf)
+	return err
+}
+
+func (w *gzipResponseWriter) compressible(contentType string) bool {
+	contentType = strings.ToLower(strings.TrimSpace(strings.SplitN(contentType, ";", 2)[0]))
+	for _, t := range w.types {
+		if strings.HasSuffix(t, "/") && strings.HasPrefix(contentType, t) || contentType == t {
+			return true
+		}
+	}
+	return false
+}
+
+// Flush commits to a decision early, so streamed responses reach the
+// client as they are written.
+func (w *gzipResponseWriter) Flush() {
+	if !w.decided {
+		w.decide(true)
+	}
+	if w.gz != nil && w.err == nil {
+		if err := w.gz.Flush(); err != nil {
+			w.fail(err)
+		}
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the connection for deadlines.
+func (w *gzipResponseWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
+
+// Close flushes a response that never reached minSize and returns the
+// gzip writer to the pool, detached from this response even if it failed.
+func (w *gzipResponseWriter) Close() {
+	if !w.decided {
+		w.decide(false)
+	}
+	if w.gz != nil {
+		if w.err == nil {
+			if err := w.gz.Close(); err != nil {
+				w.fail(err)
+			}
+		}
+		w.gz.Reset(io.Discard)
+		w.pool.Put(w.gz)
+		w.gz = nil
+	}
 }
@@ -0,0 +1,1361 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pierrec/lz4/v4"
+)
+
+// ============================================
+// Test Harness
+// ============================================
+
+// newTestServer runs an isolated server behind httptest, storing uploads
+// in a temp dir. tweak, if given, adjusts the config before construction.
+func newTestServer(t testing.TB, tweak func(*Config)) (*Server, *httptest.Server) {
+	t.Helper()
+	cfg := NewConfig()
+	cfg.UploadDir = t.TempDir()
+	if tweak != nil {
+		tweak(cfg)
+	}
+	s, err := NewServer(cfg)
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	ts := httptest.NewServer(s.Handler())
+	t.Cleanup(ts.Close)
+	return s, ts
+}
+
+// dialWS opens a signaling connection to path (e.g. "/ws/ABCDEF?is_host=true").
+func dialWS(t testing.TB, ts *httptest.Server, path string) (*websocket.Conn, *http.Response, error) {
+	t.Helper()
+	url := "ws" + strings.TrimPrefix(ts.URL, "http") + path
+	conn, resp, err := websocket.DefaultDialer.Dial(url, nil)
+	if err == nil {
+		t.Cleanup(func() { conn.Close() })
+	}
+	return conn, resp, err
+}
+
+// mustDialWS is dialWS for connections that are expected to upgrade.
+func mustDialWS(t testing.TB, ts *httptest.Server, path string) *websocket.Conn {
+	t.Helper()
+	conn, _, err := dialWS(t, ts, path)
+	if err != nil {
+		t.Fatalf("dial %s: %v", path, err)
+	}
+	return conn
+}
+
+// readMsg reads one JSON message, failing the test after a second.
+func readMsg(t testing.TB, conn *websocket.Conn) map[string]interface{} {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	var msg map[string]interface{}
+	if err := conn.ReadJSON(&msg); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	return msg
+}
+
+// readType skips messages until one of type msgType arrives.
+func readType(t testing.TB, conn *websocket.Conn, msgType string) map[string]interface{} {
+	t.Helper()
+	for {
+		if msg := readMsg(t, conn); msg["type"] == msgType {
+			return msg
+		}
+	}
+}
+
+// waitFor polls cond for up to a second.
+func waitFor(t testing.TB, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestServerHealth(t *testing.T) {
+	_, ts := newTestServer(t, func(cfg *Config) { cfg.ServerName = "test" })
+
+	resp, err := http.Get(ts.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var body map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || body["status"] != "ok" || body["server"] != "test" {
+		t.Errorf("health = %d %v", resp.StatusCode, body)
+	}
+}
+
+func TestServersAreIsolated(t *testing.T) {
+	a, ats := newTestServer(t, nil)
+	b, _ := newTestServer(t, nil)
+
+	mustDialWS(t, ats, "/ws/ABCDEF?is_host=true")
+	waitFor(t, "room on server a", func() bool { return a.rooms.GetRoom("ABCDEF") != nil })
+	if b.rooms.GetRoom("ABCDEF") != nil {
+		t.Error("room created on one server is visible on another")
+	}
+}
+
+// ============================================
+// Room Codes
+// ============================================
+
+func TestNormalizeCode(t *testing.T) {
+	rm, err := NewRoomManager(NewConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name, in, want string
+		ok             bool
+	}{
+		{"valid", "ABCDEF", "ABCDEF", true},
+		{"digits", "AB2345", "AB2345", true},
+		{"lowercase", "abcdef", "ABCDEF", true},
+		{"mixed case", "aBcDeF", "ABCDEF", true},
+		{"too short", "ABC", "ABC", false},
+		{"too long", "ABCDEFG", "ABCDEFG", false},
+		{"empty", "", "", false},
+		{"ambiguous O", "ABCDEO", "ABCDEO", false},
+		{"ambiguous I", "ABCDEI", "ABCDEI", false},
+		{"digit 0", "ABCDE0", "ABCDE0", false},
+		{"digit 1", "ABCDE1", "ABCDE1", false},
+		{"punctuation", "ABC-EF", "ABC-EF", false},
+		{"space", "ABC EF", "ABC EF", false},
+		{"non-ASCII", "ABCDÉ", "ABCDÉ", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := rm.NormalizeCode(tt.in)
+			if got != tt.want || ok != tt.ok {
+				t.Errorf("NormalizeCode(%q) = %q, %v; want %q, %v", tt.in, got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestNormalizeCodeHonoursLength(t *testing.T) {
+	cfg := NewConfig()
+	cfg.RoomCodeLength = 8
+	rm, err := NewRoomManager(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := rm.NormalizeCode("ABCDEF"); ok {
+		t.Error("6-character code accepted with RoomCodeLength 8")
+	}
+	if _, ok := rm.NormalizeCode("ABCDEFGH"); !ok {
+		t.Error("8-character code rejected with RoomCodeLength 8")
+	}
+}
+
+func TestBadRoomCodesRejected(t *testing.T) {
+	s, ts := newTestServer(t, nil)
+
+	for _, code := range []string{"ABC", "ABCDEFG", "ABCDE0", "ABC%21EF"} {
+		resp, err := http.Get(ts.URL + "/api/rooms/" + code)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("GET /api/rooms/%s = %d, want 400", code, resp.StatusCode)
+		}
+
+		_, resp, err = dialWS(t, ts, "/ws/"+code+"?is_host=true")
+		if err == nil {
+			t.Errorf("/ws/%s upgraded", code)
+			continue
+		}
+		if resp == nil || resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("/ws/%s = %v, want 400", code, resp)
+		}
+	}
+	if n := s.rooms.RoomCount(); n != 0 {
+		t.Errorf("bad codes created %d rooms", n)
+	}
+}
+
+func TestLowercaseRoomCodeJoinsRoom(t *testing.T) {
+	_, ts := newTestServer(t, nil)
+
+	host := mustDialWS(t, ts, "/ws/abcdef?is_host=true")
+	if code := readType(t, host, "room-joined")["roomCode"]; code != "ABCDEF" {
+		t.Errorf("roomCode = %v, want ABCDEF", code)
+	}
+
+	resp, err := http.Get(ts.URL + "/api/rooms/abcdef")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("GET /api/rooms/abcdef = %d, want 200", resp.StatusCode)
+	}
+}
+
+// ============================================
+// Signaling
+// ============================================
+
+// joinPair connects a host and a guest to code and drains their join
+// messages.
+func joinPair(t testing.TB, ts *httptest.Server, code string) (host, guest *websocket.Conn) {
+	t.Helper()
+	host = mustDialWS(t, ts, "/ws/"+code+"?is_host=true&peer_id=host")
+	readType(t, host, "room-joined")
+	guest = mustDialWS(t, ts, "/ws/"+code+"?peer_id=guest")
+	readType(t, guest, "room-joined")
+	readType(t, host, "peer-joined")
+	return host, guest
+}
+
+func TestMessageWithoutTypeRejected(t *testing.T) {
+	_, ts := newTestServer(t, nil)
+	host, guest := joinPair(t, ts, "ABCDEF")
+
+	for _, raw := range []string{`{}`, `{"sdp":"x"}`, `{"type":""}`, `{"type":42}`} {
+		if err := guest.WriteMessage(websocket.TextMessage, []byte(raw)); err != nil {
+			t.Fatal(err)
+		}
+		if msg := readMsg(t, guest); msg["type"] != "error" || msg["code"] != "MISSING_TYPE" {
+			t.Errorf("%s: got %v, want MISSING_TYPE", raw, msg)
+		}
+	}
+
+	// Only the typed message reaches the host
+	guest.WriteJSON(map[string]string{"type": "ping-test"})
+	if msg := readMsg(t, host); msg["type"] != "ping-test" {
+		t.Errorf("host got %v, want only the typed message", msg)
+	}
+}
+
+// localPeer returns the server side of peerID's connection in code.
+func localPeer(t testing.TB, s *Server, code, peerID string) *Peer {
+	t.Helper()
+	room := s.rooms.GetRoom(code)
+	if room == nil {
+		t.Fatalf("room %s not found", code)
+	}
+	val, ok := room.Peers.Load(peerID)
+	if !ok {
+		t.Fatalf("peer %s not in %s", peerID, code)
+	}
+	return val.(*Peer)
+}
+
+func TestSendOnClosedConnRemovesPeer(t *testing.T) {
+	s, ts := newTestServer(t, nil)
+	host, _ := joinPair(t, ts, "ABCDEF")
+	room := s.rooms.GetRoom("ABCDEF")
+
+	guest := localPeer(t, s, "ABCDEF", "guest")
+	guest.Conn.Close() // underneath the peer, as a dropped socket would be
+
+	if err := guest.SendJSON(map[string]string{"type": "notice"}); err == nil {
+		t.Fatal("SendJSON on a closed connection succeeded")
+	}
+	if err := guest.SendJSON(map[string]string{"type": "notice"}); err != errPeerClosed {
+		t.Errorf("second SendJSON = %v, want errPeerClosed", err)
+	}
+	waitFor(t, "guest removal", func() bool { return room.PeerCount() == 1 })
+	if msg := readType(t, host, "peer-left"); msg["peerId"] != "guest" {
+		t.Errorf("peer-left = %v", msg)
+	}
+}
+
+// Peers that drop while a broadcast is writing to them must not panic or
+// deadlock the broadcaster, and must still be removed.
+func TestBroadcastWhilePeersLeave(t *testing.T) {
+	const peers = 8
+	s, ts := newTestServer(t, func(cfg *Config) { cfg.MaxPeersPerRoom = peers })
+
+	conns := []*websocket.Conn{mustDialWS(t, ts, "/ws/ABCDEF?is_host=true")}
+	for i := 1; i < peers; i++ {
+		conns = append(conns, mustDialWS(t, ts, "/ws/ABCDEF"))
+	}
+	room := s.rooms.GetRoom("ABCDEF")
+	waitFor(t, "all peers", func() bool { return room.PeerCount() == peers })
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 200; i++ {
+			s.rooms.Broadcast(room, map[string]interface{}{"type": "notice", "n": i})
+		}
+	}()
+	for _, c := range conns[1:] {
+		c.Close()
+	}
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("broadcast deadlocked")
+	}
+	waitFor(t, "departed peers removed", func() bool { return room.PeerCount() == 1 })
+}
+
+// ============================================
+// File Relay
+// ============================================
+
+// uploadFile posts data as a multipart upload; query is appended to the
+// upload URL. It returns the status and the decoded JSON body, if any.
+func uploadFile(t testing.TB, ts *httptest.Server, name string, data []byte, query string) (int, map[string]interface{}) {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	part, err := mw.CreateFormFile("file", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(data)
+	mw.Close()
+
+	resp, err := http.Post(ts.URL+"/api/relay/upload"+query, mw.FormDataContentType(), &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var out map[string]interface{}
+	json.NewDecoder(resp.Body).Decode(&out)
+	return resp.StatusCode, out
+}
+
+// A failed upload hands its one-shot ticket back; only a stored file uses
+// it up.
+func TestFailedUploadKeepsTicket(t *testing.T) {
+	s, ts := newTestServer(t, nil)
+	ticket := s.relay.IssueTicket("ABCDEF")
+	query := "?token=" + ticket.Token
+
+	wrong := strings.Repeat("0", 64)
+	if status, _ := uploadFile(t, ts, "a.txt", []byte("hello"), query+"&expectedSha256="+wrong); status != http.StatusUnprocessableEntity {
+		t.Fatalf("checksum mismatch: status %d, want 422", status)
+	}
+	status, out := uploadFile(t, ts, "a.txt", []byte("hello"), query)
+	if status != http.StatusOK {
+		t.Fatalf("retry with the same token: status %d (%v), want 200", status, out)
+	}
+	if meta, ok := s.relay.files.Load(out["fileId"]); !ok || meta.(*FileMeta).RoomCode != "ABCDEF" {
+		t.Errorf("stored file not bound to the ticket's room")
+	}
+	if status, _ := uploadFile(t, ts, "a.txt", []byte("hello"), query); status != http.StatusForbidden {
+		t.Errorf("reuse after success: status %d, want 403", status)
+	}
+}
+
+// mustUpload uploads data and returns its file ID.
+func mustUpload(t testing.TB, ts *httptest.Server, name string, data []byte, query string) string {
+	t.Helper()
+	status, out := uploadFile(t, ts, name, data, query)
+	if status != http.StatusOK {
+		t.Fatalf("upload %s = %d %v", name, status, out)
+	}
+	return out["fileId"].(string)
+}
+
+// cancelingWriter cancels its request once the first body bytes arrive,
+// as a client hanging up mid-download would.
+type cancelingWriter struct {
+	*httptest.ResponseRecorder
+	cancel  context.CancelFunc
+	written int
+}
+
+func (w *cancelingWriter) Write(p []byte) (int, error) {
+	w.written += len(p)
+	w.cancel()
+	return w.ResponseRecorder.Write(p)
+}
+
+func TestDownloadStopsWhenClientCancels(t *testing.T) {
+	const size = 16 << 20
+	s, ts := newTestServer(t, func(cfg *Config) { cfg.DownloadStall = 0 })
+	for _, query := range []string{"?compress=false", ""} {
+		id := mustUpload(t, ts, "big.bin", bytes.Repeat([]byte("sendit"), size/6), query)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		req := httptest.NewRequest(http.MethodGet, "/api/relay/download/"+id, nil).WithContext(ctx)
+		w := &cancelingWriter{ResponseRecorder: httptest.NewRecorder(), cancel: cancel}
+		s.relay.Download(w, req)
+
+		if w.written == 0 || w.written > s.cfg.ChunkSize {
+			t.Errorf("upload%s: %d bytes written after cancel, want at most one %d-byte chunk",
+				query, w.written, s.cfg.ChunkSize)
+		}
+	}
+}
+
+func TestCtxReader(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &ctxReader{ctx: ctx, r: bytes.NewReader(make([]byte, 64))}
+	if n, err := r.Read(make([]byte, 16)); n != 16 || err != nil {
+		t.Fatalf("Read before cancel = %d, %v", n, err)
+	}
+	cancel()
+	if n, err := r.Read(make([]byte, 16)); n != 0 || err != context.Canceled {
+		t.Errorf("Read after cancel = %d, %v; want 0, context.Canceled", n, err)
+	}
+	if _, err := io.ReadAll(r); err != context.Canceled {
+		t.Errorf("ReadAll after cancel = %v", err)
+	}
+}
+
+// The slow-start rate follows the configured ramp: it never overflows on
+// long ramps and only reaches its ceiling as the ramp ends.
+func TestSlowStartRampFollowsLength(t *testing.T) {
+	const initial = 512 * 1024
+	for _, ramp := range []time.Duration{10 * time.Second, 5 * time.Minute, time.Hour} {
+		b := newSlowStartBody(context.Background(), io.NopCloser(bytes.NewReader(nil)), initial, ramp)
+		last := int64(0)
+		for i := 0; i <= 100; i++ {
+			rate := b.rateAt(ramp * time.Duration(i) / 100)
+			if rate < last {
+				t.Fatalf("ramp %s: rate fell to %d at %d%%", ramp, rate, i)
+			}
+			last = rate
+		}
+		if got := b.rateAt(0); got != initial {
+			t.Errorf("ramp %s: starts at %d, want %d", ramp, got, initial)
+		}
+		if got, want := b.rateAt(ramp/2), int64(initial<<(slowStartDoublings/2)); got != want {
+			t.Errorf("ramp %s: halfway rate %d, want %d", ramp, got, want)
+		}
+		if got, want := b.rateAt(ramp), int64(initial<<slowStartDoublings); got != want {
+			t.Errorf("ramp %s: final rate %d, want %d", ramp, got, want)
+		}
+	}
+}
+
+func TestValidFileID(t *testing.T) {
+	tests := []struct {
+		id string
+		ok bool
+	}{
+		{generateFileID(), true},
+		{"0123456789abcdef01234567", true},
+		{"0123456789ABCDEF01234567", false}, // generateFileID is lowercase
+		{"0123456789abcdef0123456", false},
+		{"0123456789abcdef012345678", false},
+		{"", false},
+		{"..", false},
+		{"../../../../etc/passwd", false},
+		{"0123456789abcdef/1234567", false},
+		{"0123456789abcdef\\1234567", false},
+		{"0123456789abcdef.meta", false},
+		{"0123456789abcdefg1234567", false},
+	}
+	for _, tt := range tests {
+		if got := validFileID(tt.id); got != tt.ok {
+			t.Errorf("validFileID(%q) = %v, want %v", tt.id, got, tt.ok)
+		}
+	}
+}
+
+func TestDownloadPathTraversalRejected(t *testing.T) {
+	s, _ := newTestServer(t, nil)
+
+	// A file outside the upload dir that traversal would reach
+	secret := filepath.Join(filepath.Dir(s.cfg.UploadDir), "secret")
+	if err := os.WriteFile(secret, []byte("secret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, target := range []string{
+		"/api/relay/download/..",
+		"/api/relay/download/../secret",
+		"/api/relay/download/..%2fsecret",
+		"/api/relay/download/..%5csecret",
+		"/api/relay/download/%2e%2e%2fsecret",
+		"/api/relay/download/" + strings.Repeat("../", 8) + "etc/passwd",
+		"/api/relay/download/0123456789abcdef01234567.meta",
+		"/api/relay/download/0123456789abcdef01234567/../../secret",
+	} {
+		w := httptest.NewRecorder()
+		s.relay.Download(w, httptest.NewRequest(http.MethodGet, target, nil))
+		if w.Code != http.StatusBadRequest && w.Code != http.StatusNotFound {
+			t.Errorf("GET %s = %d, want 400 or 404", target, w.Code)
+		}
+		if w.Body.String() == "secret" {
+			t.Errorf("GET %s served the file outside the upload dir", target)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	s.relay.Download(w, httptest.NewRequest(http.MethodGet, "/api/relay/download/"+strings.Repeat("a", maxDownloadPathLength), nil))
+	if w.Code != http.StatusRequestURITooLong {
+		t.Errorf("overlong path = %d, want 414", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	s.relay.DownloadZip(w, httptest.NewRequest(http.MethodGet, "/api/relay/download-zip?ids=..%2fsecret", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("zip with traversal ID = %d, want 400", w.Code)
+	}
+}
+
+// ============================================
+// Connection Accounting
+// ============================================
+
+// counters are the gauges a connection may move, for checking that a
+// rejected join leaves them as it found them.
+type counters struct {
+	conns, ownedRooms, totalConns, rooms int64
+}
+
+func snapshot(s *Server) counters {
+	return counters{
+		conns:      s.rooms.limits.Count("conn:127.0.0.1"),
+		ownedRooms: s.rooms.limits.Count("rooms:127.0.0.1"),
+		totalConns: s.rooms.totalConns.Load(),
+		rooms:      s.rooms.roomCount.Load(),
+	}
+}
+
+// expectRejected dials path, expects an error with code, and waits for
+// the server to close the socket.
+func expectRejected(t *testing.T, ts *httptest.Server, path, code string) {
+	t.Helper()
+	conn := mustDialWS(t, ts, path)
+	msg := readMsg(t, conn)
+	if got, _ := msg["code"].(string); msg["type"] != "error" || got != code {
+		t.Fatalf("%s: got %v, want error %s", path, msg, code)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, _, err := conn.ReadMessage(); err == nil {
+		t.Fatalf("%s: connection left open after %s", path, code)
+	}
+}
+
+func TestRejectedJoinsLeaveCountersUnchanged(t *testing.T) {
+	tests := []struct {
+		name  string
+		tweak func(*Config)
+		setup func(t *testing.T, ts *httptest.Server)
+		path  string
+		code  string
+	}{
+		{
+			name: "room full",
+			setup: func(t *testing.T, ts *httptest.Server) {
+				joinPair(t, ts, "ABCDEF")
+			},
+			path: "/ws/ABCDEF?peer_id=third",
+			code: "ROOM_FULL",
+		},
+		{
+			name: "duplicate peer ID",
+			setup: func(t *testing.T, ts *httptest.Server) {
+				readType(t, mustDialWS(t, ts, "/ws/ABCDEF?is_host=true&peer_id=taken"), "room-joined")
+			},
+			path: "/ws/ABCDEF?peer_id=taken",
+			code: "DUPLICATE_PEER_ID",
+		},
+		{
+			name: "room not found",
+			path: "/ws/ABCDEF?peer_id=guest",
+			code: "ROOM_NOT_FOUND",
+		},
+		{
+			name:  "reconnect backoff",
+			tweak: func(cfg *Config) { cfg.ReconnectLimit = 1 },
+			setup: func(t *testing.T, ts *httptest.Server) {
+				readType(t, mustDialWS(t, ts, "/ws/ABCDEF?is_host=true&peer_id=host"), "room-joined")
+				conn := mustDialWS(t, ts, "/ws/ABCDEF?peer_id=flappy")
+				readType(t, conn, "room-joined")
+				conn.Close()
+			},
+			path: "/ws/ABCDEF?peer_id=flappy",
+			code: "RECONNECT_BACKOFF",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, ts := newTestServer(t, tt.tweak)
+			if tt.setup != nil {
+				tt.setup(t, ts)
+			}
+			// Let connections closed in setup finish leaving
+			time.Sleep(50 * time.Millisecond)
+			before := snapshot(s)
+
+			expectRejected(t, ts, tt.path, tt.code)
+			waitFor(t, "counters to settle", func() bool { return snapshot(s) == before })
+		})
+	}
+}
+
+func TestJoinAndLeaveBalanceCounters(t *testing.T) {
+	s, ts := newTestServer(t, nil)
+	host, guest := joinPair(t, ts, "ABCDEF")
+
+	if got := snapshot(s); got.conns != 2 || got.ownedRooms != 1 || got.totalConns != 2 || got.rooms != 1 {
+		t.Errorf("with two peers: %+v", got)
+	}
+	guest.Close()
+	host.Close()
+	waitFor(t, "room teardown", func() bool { return s.rooms.GetRoom("ABCDEF") == nil })
+	want := counters{totalConns: 2} // totalConns counts every connection ever admitted
+	waitFor(t, "counters back to zero", func() bool { return snapshot(s) == want })
+}
+
+// Sockets that never send their hello count against MaxConnsPerIP, and
+// stop counting once they go.
+func TestHelloWaitCountsAgainstIPLimit(t *testing.T) {
+	s, ts := newTestServer(t, func(c *Config) {
+		c.RequireHello = true
+		c.HelloTimeout = 5 * time.Second
+		c.MaxConnsPerIP = 2
+	})
+	silent := []*websocket.Conn{
+		mustDialWS(t, ts, "/ws/ABCDEF?is_host=true"),
+		mustDialWS(t, ts, "/ws/ABCDEF?is_host=true"),
+	}
+	waitFor(t, "silent sockets counted", func() bool {
+		return s.rooms.limits.Count("hello:127.0.0.1") == 2
+	})
+	if _, resp, err := dialWS(t, ts, "/ws/ABCDEF?is_host=true"); err == nil || resp == nil || resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("third socket: err %v, want 429", err)
+	}
+
+	for _, conn := range silent {
+		conn.Close()
+	}
+	waitFor(t, "silent sockets released", func() bool {
+		return s.rooms.limits.Count("hello:127.0.0.1") == 0
+	})
+	conn := mustDialWS(t, ts, "/ws/ABCDEF?is_host=true")
+	conn.WriteJSON(map[string]interface{}{"type": "hello", "version": 1})
+	readType(t, conn, "room-joined")
+}
+
+// On the dictionary subprotocol, errors sent before the join are binary
+// dictionary frames like everything after it.
+func TestDictErrorsBeforeJoinAreBinary(t *testing.T) {
+	_, ts := newTestServer(t, func(c *Config) { c.RequireHello = true })
+	dialer := websocket.Dialer{Subprotocols: []string{dictSubprotocol}}
+	conn, _, err := dialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/ws/ABCDEF?is_host=true", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"not-hello"}`))
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	frameType, data, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if frameType != websocket.BinaryMessage {
+		t.Fatalf("frame type %d, want binary", frameType)
+	}
+	data, err = dictDecompress(data, 1<<16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var msg map[string]interface{}
+	if err := json.Unmarshal(data, &msg); err != nil || msg["code"] != "INVALID_HELLO" {
+		t.Errorf("got %s (%v), want INVALID_HELLO", data, err)
+	}
+}
+
+// failingWriter accepts limit bytes, then fails every write.
+type failingWriter struct {
+	limit int
+	n     int
+}
+
+var errInjected = errors.New("injected failure")
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if w.n+len(p) > w.limit {
+		return 0, errInjected
+	}
+	w.n += len(p)
+	return len(p), nil
+}
+
+// failingStorage stores the first limit bytes of each Put through the
+// wrapped backend and then fails, leaving a partial object behind unless
+// the caller cleans it up.
+type failingStorage struct {
+	Storage
+	limit int64
+}
+
+func (s *failingStorage) Put(id string, r io.Reader) (int64, error) {
+	n, err := s.Storage.Put(id, io.LimitReader(r, s.limit))
+	if err != nil {
+		return n, err
+	}
+	return n, errInjected
+}
+
+// storedFiles lists what is left in the upload dir.
+func storedFiles(t testing.TB, s *Server) []string {
+	t.Helper()
+	entries, err := os.ReadDir(s.cfg.UploadDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	return names
+}
+
+func TestCompressWriterErrors(t *testing.T) {
+	s, _ := newTestServer(t, nil)
+	data := bytes.Repeat([]byte("sendit "), 1<<20)
+
+	for _, tt := range []struct {
+		name  string
+		limit int
+		src   []byte
+	}{
+		{"fails on close", 0, []byte("small enough to sit in the lz4 buffer")},
+		{"fails mid-stream", 16, data}, // past the frame header
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := s.relay.compress(&failingWriter{limit: tt.limit}, bytes.NewReader(tt.src))
+			if !errors.Is(err, errInjected) {
+				t.Errorf("compress = %v, want the injected error", err)
+			}
+		})
+	}
+
+	var out bytes.Buffer
+	if n, err := s.relay.compress(&out, bytes.NewReader(data)); err != nil || n != int64(len(data)) {
+		t.Errorf("compress to a working writer = %d, %v", n, err)
+	}
+}
+
+func TestCompressedUploadFailsCleanly(t *testing.T) {
+	s, ts := newTestServer(t, nil)
+	s.relay.storage = &failingStorage{Storage: s.relay.storage, limit: 1024}
+
+	status, _ := uploadFile(t, ts, "notes.txt", bytes.Repeat([]byte("sendit "), 1<<20), "?compress=true")
+	if status != http.StatusInternalServerError {
+		t.Errorf("upload = %d, want 500", status)
+	}
+	if files := storedFiles(t, s); len(files) != 0 {
+		t.Errorf("partial files left behind: %v", files)
+	}
+	if n := s.relay.fileCount.Load(); n != 0 {
+		t.Errorf("fileCount = %d after a failed upload", n)
+	}
+}
+
+// brokenReader yields n bytes of data and then fails, like a client
+// connection dropping mid-upload.
+func brokenReader(n int) io.Reader {
+	return io.MultiReader(bytes.NewReader(bytes.Repeat([]byte("sendit "), n/7+1)[:n]), iotest.ErrReader(errInjected))
+}
+
+func TestUploadReadErrorCleansUp(t *testing.T) {
+	for _, query := range []string{"?compress=true", "?compress=false"} {
+		t.Run(query, func(t *testing.T) {
+			s, _ := newTestServer(t, nil)
+			r := httptest.NewRequest(http.MethodPost, "/api/relay/upload"+query, nil)
+
+			_, err := s.relay.store(brokenReader(3<<20), "partial.txt", "text/plain", r)
+			var ue *uploadError
+			if !errors.As(err, &ue) || ue.status != http.StatusInternalServerError {
+				t.Fatalf("store = %v, want a 500 uploadError", err)
+			}
+			if files := storedFiles(t, s); len(files) != 0 {
+				t.Errorf("partial files left behind: %v", files)
+			}
+			if n := s.relay.fileCount.Load(); n != 0 {
+				t.Errorf("fileCount = %d after a failed upload", n)
+			}
+			if s.relay.breaker.failures != 0 {
+				t.Error("a client read error counted against the storage breaker")
+			}
+		})
+	}
+}
+
+// A source error must leave the LZ4 frame unterminated, so the truncated
+// stream can never decompress as if it were complete.
+func TestCompressLeavesFrameOpenOnReadError(t *testing.T) {
+	s, _ := newTestServer(t, nil)
+	var out bytes.Buffer
+	if _, err := s.relay.compress(&out, brokenReader(5<<20)); !errors.Is(err, errInjected) {
+		t.Fatalf("compress = %v, want the injected error", err)
+	}
+	if _, err := io.Copy(io.Discard, lz4.NewReader(&out)); err == nil {
+		t.Error("truncated LZ4 stream decompressed cleanly")
+	}
+}
+
+// ============================================
+// Routing
+// ============================================
+
+func TestUnknownRoutesReturnJSON404(t *testing.T) {
+	_, ts := newTestServer(t, nil)
+
+	for _, path := range []string{"/nope", "/api", "/api/statz", "/api/rooms-list", "/favicon.ico", "/index.html"} {
+		resp, err := http.Get(ts.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var body map[string]interface{}
+		err = json.NewDecoder(resp.Body).Decode(&body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("GET %s = %d, want 404", path, resp.StatusCode)
+		}
+		if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "application/json") {
+			t.Errorf("GET %s Content-Type = %q, want JSON", path, ct)
+		}
+		if err != nil || body["error"] != "Not found" || body["path"] != path {
+			t.Errorf("GET %s body = %v (%v)", path, body, err)
+		}
+	}
+}
+
+func TestEmptyFileRoundTrip(t *testing.T) {
+	s, ts := newTestServer(t, nil)
+
+	// Even a forced compress stores a zero-byte upload as-is
+	for _, query := range []string{"", "?compress=true"} {
+		status, out := uploadFile(t, ts, "empty.txt", nil, query)
+		if status != http.StatusOK {
+			t.Fatalf("upload%s = %d %v", query, status, out)
+		}
+		if out["size"] != 0.0 || out["compressedSize"] != 0.0 || out["compressed"] != false {
+			t.Errorf("upload%s response = %v, want zero sizes, uncompressed", query, out)
+		}
+		id := out["fileId"].(string)
+		if meta, _ := s.relay.lookup(id); meta == nil || meta.CompressReason != "empty" {
+			t.Errorf("upload%s meta = %+v, want CompressReason empty", query, meta)
+		}
+
+		resp, err := http.Get(ts.URL + "/api/relay/download/" + id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || len(body) != 0 {
+			t.Errorf("download%s = %d with %d bytes, want an empty 200", query, resp.StatusCode, len(body))
+		}
+		if cl := resp.Header.Get("Content-Length"); cl != "0" {
+			t.Errorf("download%s Content-Length = %q, want 0", query, cl)
+		}
+		if ct := resp.Header.Get("Content-Type"); ct == "" {
+			t.Errorf("download%s has no Content-Type", query)
+		}
+		if resp.Header.Get("X-Original-Size") != "0" || resp.Header.Get("X-Compressed") != "false" {
+			t.Errorf("download%s headers = %v", query, resp.Header)
+		}
+	}
+}
+
+// ============================================
+// Shutdown
+// ============================================
+
+func TestDrainWaitsForInFlightUpload(t *testing.T) {
+	s, ts := newTestServer(t, nil)
+
+	// An upload whose body is still arriving when the drain starts
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	uploaded := make(chan int, 1)
+	go func() {
+		resp, err := http.Post(ts.URL+"/api/relay/upload", mw.FormDataContentType(), pr)
+		if err != nil {
+			uploaded <- 0
+			return
+		}
+		resp.Body.Close()
+		uploaded <- resp.StatusCode
+	}()
+	part, _ := mw.CreateFormFile("file", "slow.bin")
+	part.Write(bytes.Repeat([]byte("x"), 4096))
+	waitFor(t, "upload to start", func() bool { return s.relay.fileCount.Load() == 1 })
+
+	drained := make(chan struct{})
+	go func() {
+		s.relay.DrainUploads(5 * time.Second)
+		close(drained)
+	}()
+	waitFor(t, "drain to start", func() bool {
+		s.relay.uploadMu.RLock()
+		defer s.relay.uploadMu.RUnlock()
+		return s.relay.draining
+	})
+
+	if status, _ := uploadFile(t, ts, "late.txt", []byte("late"), ""); status != http.StatusServiceUnavailable {
+		t.Errorf("upload during drain = %d, want 503", status)
+	}
+	select {
+	case <-drained:
+		t.Fatal("drain returned with an upload in flight")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	part.Write(bytes.Repeat([]byte("x"), 4096))
+	mw.Close()
+	pw.Close()
+	if status := <-uploaded; status != http.StatusOK {
+		t.Errorf("in-flight upload = %d, want 200", status)
+	}
+	select {
+	case <-drained:
+	case <-time.After(time.Second):
+		t.Fatal("drain did not return once the upload finished")
+	}
+}
+
+func TestDrainGivesUpAfterGrace(t *testing.T) {
+	s, _ := newTestServer(t, nil)
+	if !s.relay.beginUpload() {
+		t.Fatal("beginUpload refused before draining")
+	}
+	defer s.relay.uploads.Done()
+
+	start := time.Now()
+	s.relay.DrainUploads(50 * time.Millisecond)
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond || elapsed > time.Second {
+		t.Errorf("drain with a stuck upload took %s, want about the 50ms grace", elapsed)
+	}
+	if s.relay.beginUpload() {
+		s.relay.uploads.Done()
+		t.Error("beginUpload accepted after draining")
+	}
+}
+
+// ============================================
+// Panic Recovery
+// ============================================
+
+func TestHandlerPanicReturns500(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/panic", func(w http.ResponseWriter, r *http.Request) {
+		var m map[string]int
+		m["boom"]++ // nil map write
+	})
+	mux.HandleFunc("/ok", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	ts := httptest.NewServer(recoverPanics(mux))
+	defer ts.Close()
+
+	for i := 0; i < 3; i++ {
+		resp, err := http.Get(ts.URL + "/panic")
+		if err != nil {
+			t.Fatalf("panicking handler dropped the connection: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusInternalServerError {
+			t.Errorf("GET /panic = %d, want 500", resp.StatusCode)
+		}
+
+		resp, err = http.Get(ts.URL + "/ok")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || string(body) != "ok" {
+			t.Errorf("GET /ok after a panic = %d %q", resp.StatusCode, body)
+		}
+	}
+}
+
+// panickingLimits panics when a message of type "boom" is rate-checked,
+// standing in for a bug in some message handler.
+type panickingLimits struct{ LimitStore }
+
+func (l panickingLimits) Hit(key string, window time.Duration) int64 {
+	if strings.HasSuffix(key, ":boom") {
+		panic("injected panic")
+	}
+	return l.LimitStore.Hit(key, window)
+}
+
+func TestReadLoopPanicCleansUpPeer(t *testing.T) {
+	s, ts := newTestServer(t, func(cfg *Config) { cfg.MsgTypeLimits = map[string]int{"boom": 1} })
+	s.rooms.limits = panickingLimits{s.rooms.limits}
+	host, guest := joinPair(t, ts, "ABCDEF")
+	room := s.rooms.GetRoom("ABCDEF")
+
+	guest.WriteJSON(map[string]string{"type": "boom"})
+	if msg := readType(t, host, "peer-left"); msg["peerId"] != "guest" {
+		t.Errorf("peer-left = %v", msg)
+	}
+	if n := room.PeerCount(); n != 1 {
+		t.Errorf("PeerCount = %d after the panic, want 1", n)
+	}
+	waitFor(t, "guest's connection gauge", func() bool { return s.rooms.limits.Count("conn:127.0.0.1") == 1 })
+
+	// The server, and the room, keep working
+	again := mustDialWS(t, ts, "/ws/ABCDEF?peer_id=guest")
+	readType(t, again, "room-joined")
+	resp, err := http.Get(ts.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("health after a panic = %d", resp.StatusCode)
+	}
+}
+
+// ============================================
+// Write Deadlines
+// ============================================
+
+// deadlineConn is a socket whose write deadline can be made to fail, as
+// it does on a connection the kernel has already torn down.
+type deadlineConn struct {
+	net.Conn
+	fail atomic.Bool
+}
+
+func (c *deadlineConn) SetWriteDeadline(t time.Time) error {
+	if c.fail.Load() {
+		return errInjected
+	}
+	return c.Conn.SetWriteDeadline(t)
+}
+
+// hijackRecorder hands an upgrade a prepared connection.
+type hijackRecorder struct {
+	*httptest.ResponseRecorder
+	conn net.Conn
+}
+
+func (h *hijackRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return h.conn, bufio.NewReadWriter(bufio.NewReader(h.conn), bufio.NewWriter(h.conn)), nil
+}
+
+// upgradeOver upgrades a WebSocket on conn, draining whatever the server
+// writes from the other end of the pipe.
+func upgradeOver(t testing.TB, conn, client net.Conn) *websocket.Conn {
+	t.Helper()
+	go io.Copy(io.Discard, client)
+	req := httptest.NewRequest(http.MethodGet, "/ws/ABCDEF", nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	ws, err := upgrader.Upgrade(&hijackRecorder{httptest.NewRecorder(), conn}, req, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ws
+}
+
+func TestFailedWriteDeadlineDropsPeer(t *testing.T) {
+	s, ts := newTestServer(t, nil)
+	host := mustDialWS(t, ts, "/ws/ABCDEF?is_host=true&peer_id=host")
+	readType(t, host, "room-joined")
+	room := s.rooms.GetRoom("ABCDEF")
+
+	server, client := net.Pipe()
+	defer client.Close()
+	conn := &deadlineConn{Conn: server}
+	peer := &Peer{ID: "guest", Conn: upgradeOver(t, conn, client), RoomCode: room.Code, IP: "192.0.2.1"}
+
+	// The same teardown handleWebSocket runs when its read loop ends
+	left := make(chan struct{})
+	s.rooms.AddPeer(room, peer)
+	go func() {
+		defer close(left)
+		for {
+			if _, _, err := peer.Conn.ReadMessage(); err != nil {
+				break
+			}
+		}
+		s.rooms.RemovePeer(room, peer)
+	}()
+	readType(t, host, "peer-joined")
+
+	conn.fail.Store(true)
+	if err := peer.SendJSON(map[string]string{"type": "notice"}); err == nil {
+		t.Fatal("SendJSON succeeded with a failing write deadline")
+	}
+	if !peer.closed.Load() {
+		t.Error("peer not marked dead")
+	}
+	select {
+	case <-left:
+	case <-time.After(time.Second):
+		t.Fatal("peer's read loop kept running after the failed deadline")
+	}
+	if msg := readType(t, host, "peer-left"); msg["peerId"] != "guest" {
+		t.Errorf("peer-left = %v", msg)
+	}
+	if room.PeerCount() != 1 || s.rooms.limits.Count("conn:192.0.2.1") != 0 {
+		t.Errorf("after removal: %d peers, %d conns from the guest", room.PeerCount(), s.rooms.limits.Count("conn:192.0.2.1"))
+	}
+	if n := peer.dropped.Load(); n != 1 {
+		t.Errorf("dropped = %d, want 1", n)
+	}
+}
+
+// ============================================
+// Room Limits
+// ============================================
+
+func TestConcurrentHostCreatesHoldMaxRooms(t *testing.T) {
+	const maxRooms, hosts = 3, 12
+	s, ts := newTestServer(t, func(cfg *Config) { cfg.MaxRooms = maxRooms })
+
+	start := make(chan struct{})
+	results := make(chan string, hosts)
+	for i := 0; i < hosts; i++ {
+		code := "ABCD" + string(roomCodeChars[i/len(roomCodeChars)]) + string(roomCodeChars[i%len(roomCodeChars)])
+		go func() {
+			<-start
+			conn, _, err := dialWS(t, ts, "/ws/"+code+"?is_host=true")
+			if err != nil {
+				results <- "dial: " + err.Error()
+				return
+			}
+			conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+			var msg map[string]interface{}
+			if err := conn.ReadJSON(&msg); err != nil {
+				results <- "read: " + err.Error()
+				return
+			}
+			if msg["type"] == "error" {
+				code, _ := msg["code"].(string)
+				results <- "error " + code
+				return
+			}
+			results <- msg["type"].(string)
+		}()
+	}
+	close(start)
+
+	counts := make(map[string]int)
+	for i := 0; i < hosts; i++ {
+		counts[<-results]++
+	}
+	if counts["room-joined"] != maxRooms || counts["error ROOM_LIMIT"] != hosts-maxRooms {
+		t.Errorf("outcomes = %v, want %d room-joined and %d ROOM_LIMIT", counts, maxRooms, hosts-maxRooms)
+	}
+	if n := s.rooms.RoomCount(); n != maxRooms {
+		t.Errorf("RoomCount = %d, want %d", n, maxRooms)
+	}
+	if n := s.rooms.roomCount.Load(); n != maxRooms {
+		t.Errorf("roomCount = %d, want %d", n, maxRooms)
+	}
+}
+
+func TestConcurrentHostCreatesShareOneRoom(t *testing.T) {
+	const hosts = 8
+	s, ts := newTestServer(t, func(cfg *Config) { cfg.MaxPeersPerRoom = hosts })
+
+	start := make(chan struct{})
+	joined := make(chan string, hosts)
+	for i := 0; i < hosts; i++ {
+		go func() {
+			<-start
+			conn, _, err := dialWS(t, ts, "/ws/ABCDEF?is_host=true")
+			if err != nil {
+				joined <- ""
+				return
+			}
+			conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+			var msg map[string]interface{}
+			conn.ReadJSON(&msg)
+			code, _ := msg["roomCode"].(string)
+			joined <- code
+		}()
+	}
+	close(start)
+	for i := 0; i < hosts; i++ {
+		if code := <-joined; code != "ABCDEF" {
+			t.Errorf("host %d joined %q", i, code)
+		}
+	}
+	if n := s.rooms.roomCount.Load(); n != 1 {
+		t.Errorf("roomCount = %d, want 1", n)
+	}
+	if n := s.rooms.GetRoom("ABCDEF").PeerCount(); n != hosts {
+		t.Errorf("PeerCount = %d, want all %d hosts in one room", n, hosts)
+	}
+}
+
+// ============================================
+// Absent Targets
+// ============================================
+
+func madeUpTargets(n int) []string {
+	ids := make([]string, n)
+	for i := range ids {
+		ids[i] = fmt.Sprintf("ghost-%d", i)
+	}
+	return ids
+}
+
+func TestTooManyTargetIdsRejected(t *testing.T) {
+	_, ts := newTestServer(t, nil)
+	host, guest := joinPair(t, ts, "ABCDEF")
+
+	host.WriteJSON(map[string]interface{}{
+		"type": "ping-test", "targetIds": append(madeUpTargets(maxRelayTargets), "guest"),
+	})
+	if msg := readType(t, host, "error"); msg["code"] != "TOO_MANY_TARGETS" {
+		t.Errorf("got %v, want TOO_MANY_TARGETS", msg)
+	}
+	host.WriteJSON(map[string]interface{}{"type": "ping-test", "targetIds": []string{"guest"}})
+	if msg := readMsg(t, guest); msg["type"] != "ping-test" {
+		t.Errorf("guest got %v, want only the message within the cap", msg)
+	}
+}
+
+// Held messages are bounded per room, and each message whose targets never
+// arrive costs the sender one aggregated PEER_GONE, not one per target.
+func TestHeldMessagesBoundedPerRoom(t *testing.T) {
+	s, ts := newTestServer(t, func(c *Config) { c.AbsentTargetHold = 300 * time.Millisecond })
+	host, _ := joinPair(t, ts, "ABCDEF")
+	targets := madeUpTargets(maxRelayTargets)
+	fits := maxHeldPerRoom / maxRelayTargets
+
+	for i := 0; i <= fits; i++ {
+		host.WriteJSON(map[string]interface{}{"type": "ping-test", "targetIds": targets, "onAbsent": "queue"})
+	}
+	// The message past the room's cap is refused at once
+	msg := readType(t, host, "error")
+	if ids, _ := msg["targetIds"].([]interface{}); msg["code"] != "PEER_GONE" || len(ids) != maxRelayTargets {
+		t.Fatalf("got %v, want PEER_GONE for every target", msg)
+	}
+	room := s.rooms.GetRoom("ABCDEF")
+	room.heldMu.Lock()
+	held, count := len(room.held), room.heldCount
+	room.heldMu.Unlock()
+	if held != maxRelayTargets || count != maxHeldPerRoom {
+		t.Errorf("holding %d messages for %d targets, want %d for %d", count, held, maxHeldPerRoom, maxRelayTargets)
+	}
+
+	for i := 0; i < fits; i++ {
+		msg := readType(t, host, "error")
+		if ids, _ := msg["targetIds"].([]interface{}); msg["code"] != "PEER_GONE" || len(ids) != maxRelayTargets {
+			t.Fatalf("expiry %d: got %v, want one PEER_GONE naming every target", i, msg)
+		}
+	}
+	host.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, data, err := host.ReadMessage(); err == nil {
+		t.Errorf("unexpected extra message %s", data)
+	}
+	room.heldMu.Lock()
+	defer room.heldMu.Unlock()
+	if len(room.held) != 0 || room.heldCount != 0 {
+		t.Errorf("%d targets, count %d left after expiry", len(room.held), room.heldCount)
+	}
+}
+
+// ============================================
+// Send Batching
+// ============================================
+
+// writeCounter counts writes reaching the socket, one syscall each on a
+// real connection.
+type writeCounter struct {
+	net.Conn
+	writes atomic.Int64
+}
+
+func (c *writeCounter) Write(p []byte) (int, error) {
+	c.writes.Add(1)
+	return c.Conn.Write(p)
+}
+
+// benchmarkFanOut relays each message to fanOut peers sharing window,
+// reporting socket writes per message delivered.
+func benchmarkFanOut(b *testing.B, fanOut int, window time.Duration) {
+	var peers []*Peer
+	var socks []*writeCounter
+	for i := 0; i < fanOut; i++ {
+		server, client := net.Pipe()
+		b.Cleanup(func() { server.Close(); client.Close() })
+		sock := &writeCounter{Conn: server}
+		ws := upgradeOver(b, sock, client)
+		socks = append(socks, sock)
+		peers = append(peers, &Peer{ID: fmt.Sprint(i), Conn: ws, batchWindow: window})
+	}
+	for _, sock := range socks {
+		sock.writes.Store(0) // not the handshake
+	}
+	msg := map[string]interface{}{
+		"type": "ice-candidate",
+		"candidate": map[string]interface{}{
+			"candidate":     "candidate:1 1 UDP 2122260223 192.168.1.2 54321 typ host",
+			"sdpMid":        "0",
+			"sdpMLineIndex": 0,
+		},
+		"senderId": "sender",
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, p := range peers {
+			p.SendJSON(msg)
+		}
+	}
+	for _, p := range peers {
+		p.flushBatch()
+	}
+	b.StopTimer()
+
+	var writes int64
+	for _, sock := range socks {
+		writes += sock.writes.Load()
+	}
+	b.ReportMetric(float64(writes)/float64(b.N*fanOut), "writes/msg")
+}
+
+func BenchmarkBatchedSend(b *testing.B) {
+	for _, fanOut := range []int{1, 8} {
+		b.Run(fmt.Sprintf("unbatched/fanout=%d", fanOut), func(b *testing.B) {
+			benchmarkFanOut(b, fanOut, 0)
+		})
+		b.Run(fmt.Sprintf("batched/fanout=%d", fanOut), func(b *testing.B) {
+			benchmarkFanOut(b, fanOut, 2*time.Millisecond)
+		})
+	}
+}
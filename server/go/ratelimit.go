@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ============================================
+// Rate Limit Store
+// ============================================
+
+// LimitStore holds the counters behind per-IP and per-peer limits. The
+// in-memory store only sees one instance; the Redis store shares counts
+// across every instance behind a load balancer.
+type LimitStore interface {
+	// Count returns the current value of a gauge, e.g. connections per IP.
+	Count(key string) int64
+	// Adjust adds delta to a gauge and returns the new value.
+	Adjust(key string, delta int64) int64
+	// Hit records one event in key's current fixed window and returns the
+	// events seen in that window so far.
+	Hit(key string, window time.Duration) int64
+}
+
+func NewLimitStore(cfg *Config) (LimitStore, error) {
+	switch cfg.LimitStore {
+	case "", "memory":
+		return newMemoryLimitStore(), nil
+	case "redis":
+		if cfg.RedisURL == "" {
+			return nil, fmt.Errorf("redis limit store requires SENDIT_GO_REDIS_URL")
+		}
+		return newRedisLimitStore(cfg.RedisURL)
+	default:
+		return nil, fmt.Errorf("unknown limit store %q", cfg.LimitStore)
+	}
+}
+
+// ============================================
+// In-Memory
+// ============================================
+
+type memoryLimitStore struct {
+	// Gauges sit behind one mutex rather than in a sync.Map of counters so
+	// a gauge can be deleted when it returns to zero without racing an
+	// increment of the same key; otherwise every IP ever seen stays mapped.
+	gaugeMu sync.Mutex
+	gauges  map[string]int64
+	windows sync.Map // map[string]*limitWindow
+}
+
+type limitWindow struct {
+	mu    sync.Mutex
+	start time.Time
+	span  time.Duration
+	n     int64
+}
+
+func newMemoryLimitStore() *memoryLimitStore {
+	return &memoryLimitStore{gauges: make(map[string]int64)}
+}
+
+func (s *memoryLimitStore) Count(key string) int64 {
+	s.gaugeMu.Lock()
+	defer s.gaugeMu.Unlock()
+	return s.gauges[key]
+}
+
+func (s *memoryLimitStore) Adjust(key string, delta int64) int64 {
+	s.gaugeMu.Lock()
+	defer s.gaugeMu.Unlock()
+	n := s.gauges[key] + delta
+	if n == 0 {
+		delete(s.gauges, key)
+	} else {
+		s.gauges[key] = n
+	}
+	return n
+}
+
+func (s *memoryLimitStore) Hit(key string, window time.Duration) int64 {
+	val, _ := s.windows.LoadOrStore(key, &limitWindow{})
+	w := val.(*limitWindow)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if now := time.Now(); now.Sub(w.start) >= window {
+		w.start, w.span, w.n = now, window, 0
+	}
+	w.n++
+	return w.n
+}
+
+// sweep drops windows that have ended, so per-peer keys don't accumulate.
+// Called from the room cleanup loop.
+func (s *memoryLimitStore) sweep() {
+	now := time.Now()
+	s.windows.Range(func(key, value interface{}) bool {
+		w := value.(*limitWindow)
+		w.mu.Lock()
+		done := now.Sub(w.start) >= w.span
+		w.mu.Unlock()
+		if done {
+			s.windows.Delete(key)
+		}
+		return true
+	})
+}
+
+// ============================================
+// Redis
+// ============================================
+
+// Gauges are refreshed on every Adjust and expire after redisGaugeTTL, so
+// counts held by a crashed instance eventually clear.
+const redisGaugeTTL = 2 * time.Hour
+
+type redisLimitStore struct {
+	rdb *redis.Client
+}
+
+func newRedisLimitStore(url string) (*redisLimitStore, error) {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+	rdb := redis.NewClient(opts)
+	ctx, cancel := opContext()
+	defer cancel()
+	if err := rdb.Ping(ctx).Err(); err != nil {
+		return nil, err
+	}
+	return &redisLimitStore{rdb: rdb}, nil
+}
+
+func limitKey(key string) string { return "sendit:limit:" + key }
+
+// Redis errors fail open: an unreachable Redis must not lock every client
+// out, so the affected check sees a zero count.
+
+func (s *redisLimitStore) Count(key string) int64 {
+	ctx, cancel := opContext()
+	defer cancel()
+	n, err := s.rdb.Get(ctx, limitKey(key)).Int64()
+	if err != nil && err != redis.Nil {
+		log.Printf("[Limits] Count %s failed: %v", key, err)
+	}
+	return n
+}
+
+func (s *redisLimitStore) Adjust(key string, delta int64) int64 {
+	ctx, cancel := opContext()
+	defer cancel()
+	pipe := s.rdb.TxPipeline()
+	incr := pipe.IncrBy(ctx, limitKey(key), delta)
+	pipe.Expire(ctx, limitKey(key), redisGaugeTTL)
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Printf("[Limits] Adjust %s failed: %v", key, err)
+		return 0
+	}
+	return incr.Val()
+}
+
+func (s *redisLimitStore) Hit(key string, window time.Duration) int64 {
+	bucket := time.Now().UnixNano() / int64(window)
+	k := fmt.Sprintf("%s:%d", limitKey(key), bucket)
+
+	ctx, cancel := opContext()
+	defer cancel()
+	pipe := s.rdb.TxPipeline()
+	incr := pipe.Incr(ctx, k)
+	pipe.Expire(ctx, k, 2*window)
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Printf("[Limits] Hit %s failed: %v", key, err)
+		return 0
+	}
+	return incr.Val()
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// Connect/disconnect churn from many addresses must leave no gauges
+// behind, including when increments and the final decrement of one key
+// race each other. Run with -race.
+func TestMemoryGaugesDeletedAtZero(t *testing.T) {
+	const (
+		ips     = 500
+		workers = 16
+		cycles  = 200
+	)
+	s := newMemoryLimitStore()
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < cycles; i++ {
+				// Workers overlap on addresses, so keys are shared
+				ip := (w*cycles + i) % ips
+				key := fmt.Sprintf("conn:10.0.%d.%d", ip/256, ip%256)
+				if n := s.Adjust(key, 1); n < 1 {
+					t.Errorf("Adjust(%s, 1) = %d", key, n)
+				}
+				s.Count(key)
+				s.Adjust(key, -1)
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	s.gaugeMu.Lock()
+	defer s.gaugeMu.Unlock()
+	if len(s.gauges) != 0 {
+		t.Errorf("%d gauges left after every connection closed", len(s.gauges))
+	}
+}
+
+func TestMemoryGaugeKeepsNonZeroCounts(t *testing.T) {
+	s := newMemoryLimitStore()
+	s.Adjust("conn:a", 1)
+	s.Adjust("conn:a", 1)
+	s.Adjust("conn:a", -1)
+	if n := s.Count("conn:a"); n != 1 {
+		t.Errorf("Count = %d, want 1", n)
+	}
+	s.Adjust("conn:a", -1)
+	if n := s.Count("conn:a"); n != 0 {
+		t.Errorf("Count = %d, want 0", n)
+	}
+	if _, ok := s.gauges["conn:a"]; ok {
+		t.Error("gauge kept at zero")
+	}
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+)
+
+// ============================================
+// Protocol Schema
+// ============================================
+
+// The schema served at /api/schema describes every signaling message and
+// HTTP endpoint as JSON Schema (draft 2020-12) so clients can validate
+// against the contract instead of reading relay code. Request bodies are
+// generated from their Go structs; messages are built as maps in the
+// handlers, so their shapes are listed here and must be kept in step.
+
+const schemaDialect = "https://json-schema.org/draft/2020-12/schema"
+
+// errorCodes are the values of "code" in {"type":"error"} messages.
+var errorCodes = []string{
+	"BAD_FRAME", "DUPLICATE_PEER_ID", "HANDSHAKE_TIMEOUT", "INVALID_ADOPT", "INVALID_HELLO", "INVALID_HOST_TRANSFER", "INVALID_STREAM",
+	"INVALID_TRANSFER", "MISSING_TYPE", "NOT_HOST", "PEER_GONE", "RATE_LIMITED",
+	"RECONNECT_BACKOFF", "ROOM_CLOSED", "ROOM_FULL", "ROOM_LIMIT", "ROOM_NOT_FOUND", "SERVER_FULL",
+	"STREAM_WINDOW_FULL", "TOO_MANY_CONNECTIONS", "TOO_MANY_ROOMS", "TOO_MANY_TARGETS", "TYPE_RATE_LIMITED", "UNKNOWN_TARGETS",
+}
+
+// schemaOf derives a schema from t's exported fields and json tags.
+func schemaOf(t reflect.Type) map[string]interface{} {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return jsString
+	case reflect.Bool:
+		return jsBool
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return jsInt
+	case reflect.Float32, reflect.Float64:
+		return jsNumber
+	case reflect.Slice, reflect.Array:
+		return jsArray(schemaOf(t.Elem()))
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": schemaOf(t.Elem())}
+	case reflect.Struct:
+		props := make(map[string]interface{})
+		var required []string
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if !f.IsExported() {
+				continue
+			}
+			name, opts, _ := strings.Cut(f.Tag.Get("json"), ",")
+			if name == "-" {
+				continue
+			}
+			if name == "" {
+				name = f.Name
+			}
+			props[name] = schemaOf(f.Type)
+			if opts != "omitempty" {
+				required = append(required, name)
+			}
+		}
+		s := map[string]interface{}{"type": "object", "properties": props}
+		if len(required) > 0 {
+			s["required"] = required
+		}
+		return s
+	}
+	return map[string]interface{}{}
+}
+
+var (
+	jsString = map[string]interface{}{"type": "string"}
+	jsBool   = map[string]interface{}{"type": "boolean"}
+	jsInt    = map[string]interface{}{"type": "integer"}
+	jsNumber = map[string]interface{}{"type": "number"}
+	jsAny    = map[string]interface{}{}
+)
+
+func jsArray(items map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{"type": "array", "items": items}
+}
+
+// jsObject builds an object schema; properties named in required must be
+// present, others are optional.
+func jsObject(props map[string]interface{}, required ...string) map[string]interface{} {
+	s := map[string]interface{}{"type": "object", "properties": props}
+	if len(required) > 0 {
+		s["required"] = required
+	}
+	return s
+}
+
+// signalMessage is one signaling message type. From is "client" or
+// "server"; client messages that are relayed reach the other peers with
+// senderId added, plus serverSeq and serverTs when stamping is on.
+type signalMessage struct {
+	Type        string
+	From        string
+	Description string
+	Props       map[string]interface{}
+	Required    []string
+}
+
+func (m signalMessage) schema() map[string]interface{} {
+	props := map[string]interface{}{"type": map[string]interface{}{"const": m.Type}}
+	for name, s := range m.Props {
+		props[name] = s
+	}
+	s := jsObject(props, append([]string{"type"}, m.Required...)...)
+	s["description"] = m.Description
+	s["x-from"] = m.From
+	return s
+}
+
+// relayProps are fields any relayed message may carry.
+var relayProps = map[string]interface{}{
+	"targetId":  jsString,
+	"targetIds": map[string]interface{}{"type": "array", "items": jsString, "maxItems": maxRelayTargets},
+	"msgId":     jsString,
+	"onAbsent":  map[string]interface{}{"type": "string", "enum": []string{absentDrop, absentError, absentQueue}},
+}
+
+func withRelayProps(props map[string]interface{}) map[string]interface{} {
+	out := make(map[string]interface{}, len(props)+len(relayProps))
+	for k, v := range relayProps {
+		out[k] = v
+	}
+	for k, v := range props {
+		out[k] = v
+	}
+	return out
+}
+
+var offerFile = jsObject(map[string]interface{}{
+	"id": jsString, "name": jsString, "size": jsInt,
+}, "id", "name", "size")
+
+var signalMessages = []signalMessage{
+	// Client to server
+	{"hello", "client", "First message when helloRequired is set in capabilities",
+		map[string]interface{}{"version": map[string]interface{}{"type": []string{"string", "number"}}},
+		[]string{"version"}},
+	{"offer", "client", "WebRTC offer, relayed to the other peers",
+		withRelayProps(map[string]interface{}{"sdp": jsAny}), []string{"sdp"}},
+	{"answer", "client", "WebRTC answer, relayed to the other peers",
+		withRelayProps(map[string]interface{}{"sdp": jsAny}), []string{"sdp"}},
+	{"ice-candidate", "client", "Trickled ICE candidate, relayed to the other peers",
+		withRelayProps(map[string]interface{}{"candidate": jsAny}), []string{"candidate"}},
+	{"request-relay", "client", "P2P failed; the sender gets relay-info and the message is relayed",
+		withRelayProps(nil), nil},
+	{"get-peers", "client", "Asks for a peers roster; not relayed", nil, nil},
+	{"get-capabilities", "client", "Asks for a capabilities message; not relayed", nil, nil},
+	{"get-conn-stats", "client", "Asks for a conn-stats message; not relayed", nil, nil},
+	{"renegotiate", "client", "Renegotiation request; acked with renegotiate-ack and relayed with seq",
+		withRelayProps(nil), nil},
+	{"transfer-offer", "client", "Offers files to the other peers",
+		withRelayProps(map[string]interface{}{"offerId": jsString, "files": jsArray(offerFile)}),
+		[]string{"offerId", "files"}},
+	{"transfer-accept", "client", "Accepts a pending transfer-offer from another peer",
+		withRelayProps(map[string]interface{}{"offerId": jsString}), []string{"offerId"}},
+	{"transfer-reject", "client", "Rejects a pending transfer-offer from another peer",
+		withRelayProps(map[string]interface{}{"offerId": jsString}), []string{"offerId"}},
+	{"transfer-host", "client", "Host only: hands the host role to another peer on this instance",
+		map[string]interface{}{"toPeerId": jsString}, []string{"toPeerId"}},
+	{"close-room", "client", "Host only: closes the room for everyone", nil, nil},
+	{"adopt-file", "client", "Takes over the delete token of a file uploaded to this room",
+		map[string]interface{}{"fileId": jsString}, []string{"fileId"}},
+	{"stream-start", "client", "Opens an in-band stream",
+		withRelayProps(map[string]interface{}{"streamId": jsString}), []string{"streamId"}},
+	{"stream-chunk", "client", "Next chunk of a stream, in seq order",
+		withRelayProps(map[string]interface{}{"streamId": jsString, "seq": jsInt, "data": jsString}),
+		[]string{"streamId", "seq"}},
+	{"stream-ack", "client", "Receiver acknowledges stream chunks up to seq",
+		withRelayProps(map[string]interface{}{"streamId": jsString, "seq": jsInt}),
+		[]string{"streamId", "seq"}},
+	{"stream-end", "client", "Closes a stream",
+		withRelayProps(map[string]interface{}{"streamId": jsString}), []string{"streamId"}},
+
+	// Server to client
+	{"room-joined", "server", "Sent to a peer once it has joined",
+		map[string]interface{}{
+			"roomCode": jsString, "peerId": jsString, "isHost": jsBool, "peerCount": jsInt,
+			"peers": jsArray(jsString), "maxMessageSize": jsInt, "polite": jsBool,
+			"reconnectToken": jsString,
+		},
+		[]string{"roomCode", "peerId", "isHost", "peerCount", "peers", "maxMessageSize", "polite", "reconnectToken"}},
+	{"peer-joined", "server", "Another peer joined; polite is the receiver's role toward it",
+		map[string]interface{}{"peerId": jsString, "isHost": jsBool, "peerCount": jsInt, "polite": jsBool},
+		[]string{"peerId", "isHost", "peerCount", "polite"}},
+	{"peer-left", "server", "Another peer left",
+		map[string]interface{}{"peerId": jsString, "peerCount": jsInt}, []string{"peerId", "peerCount"}},
+	{"peers", "server", "Reply to get-peers",
+		map[string]interface{}{"roomCode": jsString, "peerId": jsString, "peerCount": jsInt, "peers": jsArray(jsString)},
+		[]string{"roomCode", "peerId", "peerCount", "peers"}},
+	{"relay-info", "server", "Upload ticket, reply to request-relay",
+		map[string]interface{}{
+			"uploadToken": jsString, "uploadUrl": jsString, "rawUploadUrl": jsString,
+			"expiresAt": jsInt, "maxFileSize": jsInt,
+		},
+		[]string{"uploadToken", "uploadUrl", "rawUploadUrl", "expiresAt", "maxFileSize"}},
+	{"conn-stats", "server", "Reply to get-conn-stats",
+		map[string]interface{}{
+			"compression": jsBool, "messagesSent": jsInt, "bytesSent": jsInt,
+			"bytesCompressed": jsInt, "rttMs": jsInt, "pingIntervalMs": jsInt,
+		}, nil},
+	{"capabilities", "server", "Reply to get-capabilities; same body as GET /api/capabilities", nil, nil},
+	{"renegotiate-ack", "server", "Sequence stamped on the sender's renegotiate",
+		map[string]interface{}{"seq": jsInt}, []string{"seq"}},
+	{"host-changed", "server", "The host role moved",
+		map[string]interface{}{"hostId": jsString, "previousId": jsString}, []string{"hostId", "previousId"}},
+	{"file-adopted", "server", "Reply to adopt-file; the previous token no longer works",
+		map[string]interface{}{"fileId": jsString, "deleteToken": jsString}, []string{"fileId", "deleteToken"}},
+	{"room-closed", "server", "The room was closed; a close frame follows. by is the closing peer, or \"server\" with a reason",
+		map[string]interface{}{"by": jsString, "reason": jsString}, []string{"by"}},
+	{"room-throttled", "server", "The room exceeded its message or byte rate",
+		map[string]interface{}{"retryAfterMs": jsInt}, []string{"retryAfterMs"}},
+	{"stream-pause", "server", "The stream window is full; wait for stream-resume",
+		map[string]interface{}{"streamId": jsString}, []string{"streamId"}},
+	{"stream-resume", "server", "The receiver caught up; chunks may flow again",
+		map[string]interface{}{"streamId": jsString}, []string{"streamId"}},
+	{"queued", "server", "Waiting for admission, before room-joined",
+		map[string]interface{}{"position": jsInt}, []string{"position"}},
+	{"batch", "server", "Several messages in one frame, for batching connections",
+		map[string]interface{}{"messages": jsArray(jsObject(nil, "type"))}, []string{"messages"}},
+	{"notice", "server", "Operator message of the day",
+		map[string]interface{}{"message": jsString, "server": jsString, "supportUrl": jsString}, []string{"message"}},
+	{"announcement", "server", "Operator broadcast",
+		map[string]interface{}{"message": jsString, "server": jsString, "supportUrl": jsString}, []string{"message"}},
+	{"error", "server", "A message was refused",
+		map[string]interface{}{
+			"code": map[string]interface{}{"type": "string", "enum": errorCodes}, "message": jsString,
+			"retryAfter": jsNumber, "offerId": jsAny, "streamId": jsAny, "targetId": jsString, "targetIds": jsArray(jsString), "fileId": jsString,
+			"messageType": jsString,
+		},
+		[]string{"code", "message"}},
+}
+
+// endpoint is one HTTP route. Request and Response are schemas of JSON
+// bodies, nil where the body is not JSON or there is none.
+type endpoint struct {
+	Method      string
+	Path        string
+	Description string
+	Request     map[string]interface{}
+	Response    map[string]interface{}
+}
+
+var uploadResponse = jsObject(map[string]interface{}{
+	"fileId": jsString, "name": jsString, "size": jsInt, "compressed": jsBool,
+	"compressedSize": jsInt, "checksum": jsString, "downloadUrl": jsString, "expiresAt": jsNumber,
+	"deleteToken": jsString,
+}, "fileId", "name", "size", "compressed", "compressedSize", "checksum", "downloadUrl", "expiresAt", "deleteToken")
+
+var endpoints = []endpoint{
+	{"GET", "/", "Health check", nil,
+		jsObject(map[string]interface{}{"status": jsString, "version": jsString}, "status", "version")},
+	{"GET", "/api/ready", "Readiness for load balancers; 503 in maintenance or while storage is failing", nil,
+		jsObject(map[string]interface{}{"status": jsString, "message": jsString, "peers": jsInt}, "status", "peers")},
+	{"GET", "/api/version", "Build information", nil,
+		jsObject(map[string]interface{}{
+			"version": jsString, "gitCommit": jsString, "buildTime": jsString, "goVersion": jsString,
+		}, "version", "gitCommit", "buildTime", "goVersion")},
+	{"GET", "/api/capabilities", "Server features and limits", nil, jsObject(nil)},
+	{"GET", "/api/schema", "This document", nil, jsObject(nil)},
+	{"GET", "/api/ws-dictionary", "Preset compression dictionary for the " + dictSubprotocol + " subprotocol", nil, nil},
+	{"GET", "/api/stats", "Server-wide counters", nil, jsObject(nil)},
+	{"GET", "/api/stats/rates", "Recent rates over ?window= seconds (default 10)", nil,
+		jsObject(map[string]interface{}{
+			"messagesPerSecond": jsNumber, "connectionsPerSecond": jsNumber,
+			"bytesPerSecond": jsNumber, "windowSeconds": jsNumber,
+		}, "messagesPerSecond", "connectionsPerSecond", "bytesPerSecond", "windowSeconds")},
+	{"POST", "/api/rooms", "Create a room, optionally with a vanity code",
+		schemaOf(reflect.TypeOf(createRoomRequest{})),
+		jsObject(map[string]interface{}{"created": jsBool, "roomCode": jsString}, "created", "roomCode")},
+	{"GET", "/api/rooms/{code}", "Room status", nil,
+		jsObject(map[string]interface{}{"code": jsString, "peerCount": jsInt, "createdAt": jsInt})},
+	{"GET", "/api/rooms/{code}/join-info", "WebSocket join URL, with a base64 PNG QR code for ?qr=true", nil,
+		jsObject(map[string]interface{}{"roomCode": jsString, "wsUrl": jsString, "qrCode": jsString}, "roomCode", "wsUrl")},
+	{"GET", "/api/rooms/{code}/kv", "The room's key-value store", nil,
+		map[string]interface{}{"type": "object"}},
+	{"POST", "/api/rooms/{code}/kv", "Merge keys into the room's store; null deletes a key",
+		map[string]interface{}{"type": "object"}, map[string]interface{}{"type": "object"}},
+	{"POST", "/api/quick-send", "Create a room and an upload ticket in one call", nil,
+		jsObject(map[string]interface{}{
+			"roomCode": jsString, "wsUrl": jsString, "uploadToken": jsString, "uploadUrl": jsString,
+			"rawUploadUrl": jsString, "expiresAt": jsInt, "maxFileSize": jsInt,
+		})},
+	{"GET", "/ws/{code}", "Signaling WebSocket; see messages", nil, nil},
+	{"POST", "/api/relay/upload", "Multipart upload, file in the \"file\" part", nil, uploadResponse},
+	{"PUT", "/api/relay/upload/raw", "Upload with the file as the request body", nil, uploadResponse},
+	{"GET", "/api/relay/download/{id}", "Download a relayed file", nil, nil},
+	{"GET", "/api/relay/download/{id}/chunk", "One chunk of a file, with ?index= and optional ?size=", nil, nil},
+	{"DELETE", "/api/relay/download/{id}", "Delete a file before its TTL, with ?deleteToken=", nil, nil},
+	{"GET", "/api/relay/download-zip", "Download several files as one zip", nil, nil},
+	{"GET", "/api/admin/rooms", "Admin: rooms on this instance, up to ?limit=", nil,
+		jsArray(jsObject(map[string]interface{}{"code": jsString, "peerCount": jsInt}))},
+	{"GET", "/api/admin/rooms/{code}", "Admin: per-peer counters for one room", nil,
+		jsObject(map[string]interface{}{
+			"code": jsString, "createdAt": jsInt, "messageCount": jsInt, "peers": jsArray(jsObject(nil)),
+		}, "code", "createdAt", "messageCount", "peers")},
+	{"GET", "/api/admin/debug", "Admin: runtime, memory and pool figures", nil, jsObject(nil)},
+	{"POST", "/api/admin/broadcast", "Admin: announce to every peer on this instance",
+		schemaOf(reflect.TypeOf(broadcastRequest{})),
+		jsObject(map[string]interface{}{"peers": jsInt, "delivered": jsInt, "failed": jsInt, "pending": jsInt})},
+	{"POST", "/api/admin/maintenance", "Admin: enter or leave maintenance mode",
+		schemaOf(reflect.TypeOf(maintenanceRequest{})), jsObject(nil)},
+}
+
+// protocolSchema is built once; it only depends on the tables above.
+var protocolSchema = func() []byte {
+	messages := make(map[string]interface{}, len(signalMessages))
+	for _, m := range signalMessages {
+		messages[m.Type] = m.schema()
+	}
+	routes := make([]interface{}, 0, len(endpoints))
+	for _, e := range endpoints {
+		route := map[string]interface{}{
+			"method":      e.Method,
+			"path":        e.Path,
+			"description": e.Description,
+		}
+		if e.Request != nil {
+			route["request"] = e.Request
+		}
+		if e.Response != nil {
+			route["response"] = e.Response
+		}
+		routes = append(routes, route)
+	}
+	data, err := json.Marshal(map[string]interface{}{
+		"$schema":   schemaDialect,
+		"version":   version,
+		"messages":  messages,
+		"endpoints": routes,
+	})
+	if err != nil {
+		panic(err)
+	}
+	return data
+}()
+
+// handleSchema serves GET /api/schema.
+func (s *Server) handleSchema(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/schema+json")
+	w.Write(protocolSchema)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/json"
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// ============================================
+// Signaling Dictionary
+// ============================================
+
+// dictSubprotocol opts a connection into dictionary compression: every
+// server frame is binary, a raw DEFLATE stream (RFC 1951) primed with
+// signalingDict, and clients may send the same or plain text frames.
+// Generic permessage-deflate starts each small frame with an empty
+// window, so an ICE candidate barely shrinks; with the JSON keys and SDP
+// boilerplate already in the window it compresses to a fraction.
+//
+// The dictionary is part of the protocol: changing a byte of it needs a
+// new subprotocol name. Clients can fetch it from /api/ws-dictionary.
+const dictSubprotocol = "sendit.dict.v1"
+
+// signalingDict holds strings common in signaling traffic, most frequent
+// last since DEFLATE reaches the end of the window most cheaply. Server
+// frames are json.Marshal output, so keys appear in sorted order.
+var signalingDict = []byte(
+	`a=extmap-allow-mixed\r\na=msid-semantic: WMS\r\n` +
+		`m=application 9 UDP/DTLS/SCTP webrtc-datachannel\r\nc=IN IP4 0.0.0.0\r\n` +
+		`a=ice-options:trickle\r\na=fingerprint:sha-256 \r\na=setup:actpass\r\na=setup:active\r\n` +
+		`a=mid:0\r\na=sctp-port:5000\r\na=max-message-size:262144\r\n` +
+		`v=0\r\no=- 2 IN IP4 127.0.0.1\r\ns=-\r\nt=0 0\r\na=group:BUNDLE 0\r\n` +
+		`a=ice-ufrag:a=ice-pwd:` +
+		`{"type":"room-joined","roomCode":"","peerId":"","isHost":false,"peerCount":2,"peers":[],"polite":true}` +
+		`{"isHost":false,"peerCount":2,"peerId":"","polite":false,"type":"peer-joined"}` +
+		`{"peerCount":1,"peerId":"","type":"peer-left"}` +
+		`{"code":"","message":"","type":"error"}` +
+		`"transfer-offer","transfer-accept","offerId":"","files":[{"name":"","size":` +
+		`{"sdp":{"sdp":"v=0\r\no=- ","type":"answer"},"senderId":"","serverSeq":1,"serverTs":1,"type":"answer"}` +
+		`{"sdp":{"sdp":"v=0\r\no=- ","type":"offer"},"senderId":"","serverSeq":1,"serverTs":1,"type":"offer"}` +
+		` typ srflx raddr 0.0.0.0 rport 0 generation 0 ufrag  network-id 1 network-cost 10` +
+		` typ host tcptype passive udp tcp 1 UDP 2122260223 192.168.` +
+		`{"candidate":{"address":"","candidate":"candidate:","component":"rtp","foundation":"","port":` +
+		`,"priority":,"protocol":"udp","relatedAddress":null,"relatedPort":null,"sdpMLineIndex":0,` +
+		`"sdpMid":"0","tcpType":null,"type":"host","usernameFragment":""},` +
+		`"senderId":"","serverSeq":1,"serverTs":1,"type":"ice-candidate"}` +
+		`{"type":"ice-candidate","candidate":{"candidate":"candidate:","sdpMid":"0","sdpMLineIndex":0,"usernameFragment":""}}`,
+)
+
+var errDictFrameTooLarge = errors.New("inflated frame exceeds the message size limit")
+
+// Frames are small enough that the best level costs little, and below it
+// the compressor skips matching on short inputs, dictionary included.
+var dictWriters = sync.Pool{
+	New: func() interface{} {
+		w, err := flate.NewWriterDict(nil, flate.BestCompression, signalingDict)
+		if err != nil {
+			panic(err) // only for an invalid level
+		}
+		return w
+	},
+}
+
+var dictReaders sync.Pool // flate readers, reset with signalingDict
+
+// dictCompress deflates one message against signalingDict.
+func dictCompress(data []byte) []byte {
+	var out bytes.Buffer
+	w := dictWriters.Get().(*flate.Writer)
+	w.Reset(&out) // keeps the dictionary
+	w.Write(data)
+	w.Close()
+	dictWriters.Put(w)
+	return out.Bytes()
+}
+
+// writeConnJSON sends v on a socket that has no Peer yet (queue updates and
+// errors before the join), in the frame format its subprotocol promises.
+func writeConnJSON(conn *websocket.Conn, v interface{}) error {
+	if conn.Subprotocol() != dictSubprotocol {
+		return conn.WriteJSON(v)
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return conn.WriteMessage(websocket.BinaryMessage, dictCompress(data))
+}
+
+// dictDecompress inflates a client frame, refusing output over limit so a
+// small frame can't expand past the read limit a text frame would hit.
+func dictDecompress(data []byte, limit int64) ([]byte, error) {
+	src := bytes.NewReader(data)
+	var r io.ReadCloser
+	if v := dictReaders.Get(); v != nil {
+		r = v.(io.ReadCloser)
+		r.(flate.Resetter).Reset(src, signalingDict)
+	} else {
+		r = flate.NewReaderDict(src, signalingDict)
+	}
+	defer dictReaders.Put(r)
+
+	out, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(out)) > limit {
+		return nil, errDictFrameTooLarge
+	}
+	return out, nil
+}
@@ -0,0 +1,548 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ============================================
+// Relay Storage
+// ============================================
+
+// Storage is where relayed file bytes live. FileRelay only ever talks to
+// this interface, so the upload dir can be swapped for shared object
+// storage when several instances sit behind one load balancer.
+type Storage interface {
+	// Put stores everything read from r under id and returns the bytes written.
+	Put(id string, r io.Reader) (int64, error)
+	// Get opens id for reading. Missing objects return os.ErrNotExist.
+	Get(id string) (io.ReadCloser, error)
+	Delete(id string) error
+	// Stat returns the stored size of id.
+	Stat(id string) (int64, error)
+}
+
+func NewStorage(cfg *Config, bufs *bufferPool) (Storage, error) {
+	primary, err := newBackend(cfg.StorageBackend, cfg.UploadDir, cfg, bufs)
+	if err != nil || cfg.Mirror == "" {
+		return primary, err
+	}
+	secondary, err := newBackend(cfg.Mirror, cfg.MirrorDir, cfg, bufs)
+	if err != nil {
+		return nil, fmt.Errorf("mirror: %w", err)
+	}
+	return &mirrorStorage{
+		primary:   primary,
+		secondary: secondary,
+		async:     cfg.MirrorAsync,
+		required:  cfg.MirrorRequired,
+	}, nil
+}
+
+// newBackend builds one storage backend; dir is only used by "local".
+func newBackend(kind, dir string, cfg *Config, bufs *bufferPool) (Storage, error) {
+	switch kind {
+	case "", "local":
+		return newLocalStorage(dir, bufs, retryPolicy{cfg.StorageRetries, cfg.StorageRetryBackoff})
+	case "s3":
+		return newS3Storage(cfg, bufs)
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", kind)
+	}
+}
+
+// storageLocations names where a stored file lives when that is more than
+// one place, else nil.
+func storageLocations(s Storage) []string {
+	if m, ok := s.(*mirrorStorage); ok {
+		return m.Locations()
+	}
+	return nil
+}
+
+// staleTempRemover is implemented by backends that spool Puts to temp files.
+type staleTempRemover interface {
+	RemoveStaleTemp(maxAge time.Duration) int
+}
+
+// ============================================
+// Local Disk
+// ============================================
+
+type localStorage struct {
+	dir   string
+	bufs  *bufferPool
+	retry retryPolicy
+}
+
+func newLocalStorage(dir string, bufs *bufferPool, retry retryPolicy) (*localStorage, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &localStorage{dir: dir, bufs: bufs, retry: retry}, nil
+}
+
+// retryPolicy retries filesystem operations that fail transiently, as
+// networked filesystems do now and then. An upload body can't be read
+// twice, so Put retries each step (create, every write, sync, rename)
+// rather than starting over.
+type retryPolicy struct {
+	retries int
+	backoff time.Duration // doubled after each retry
+}
+
+// transientStorageError reports whether err is worth retrying. Anything
+// not listed, ENOSPC and EACCES included, fails at once.
+func transientStorageError(err error) bool {
+	return errors.Is(err, syscall.EAGAIN) || errors.Is(err, syscall.EINTR) ||
+		errors.Is(err, syscall.EBUSY) || errors.Is(err, syscall.ETIMEDOUT)
+}
+
+func (p retryPolicy) do(op string, fn func() error) error {
+	delay := p.backoff
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= p.retries || !transientStorageError(err) {
+			return err
+		}
+		log.Printf("[Storage] %s failed (%v), retry %d/%d in %s", op, err, attempt+1, p.retries, delay)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// retryWriter writes through p, resuming a partial write after a
+// transient error from where it stopped.
+type retryWriter struct {
+	w io.Writer
+	p retryPolicy
+}
+
+func (rw retryWriter) Write(b []byte) (int, error) {
+	written := 0
+	err := rw.p.do("write", func() error {
+		n, err := rw.w.Write(b[written:])
+		written += n
+		return err
+	})
+	return written, err
+}
+
+var errInvalidStorageID = errors.New("invalid storage id")
+
+// path resolves id inside dir, refusing anything that could name a file
+// elsewhere (separators, "..").
+func (s *localStorage) path(id string) (string, error) {
+	if id == "" || id == "." || id == ".." || strings.ContainsAny(id, `/\`) {
+		return "", errInvalidStorageID
+	}
+	return filepath.Join(s.dir, id), nil
+}
+
+// tempSuffix marks a Put in progress. Bytes only appear under the final
+// name via rename, so a crash mid-upload never leaves a partial file there.
+const tempSuffix = ".tmp"
+
+func (s *localStorage) Put(id string, r io.Reader) (int64, error) {
+	p, err := s.path(id)
+	if err != nil {
+		return 0, err
+	}
+	tmp := p + tempSuffix
+	var f *os.File
+	if err := s.retry.do("create", func() (err error) {
+		f, err = os.Create(tmp)
+		return err
+	}); err != nil {
+		return 0, err
+	}
+
+	buf := s.bufs.get()
+	defer s.bufs.put(buf)
+
+	n, err := io.CopyBuffer(retryWriter{f, s.retry}, r, *buf)
+	if err == nil {
+		err = s.retry.do("sync", f.Sync)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = s.retry.do("rename", func() error { return os.Rename(tmp, p) })
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return 0, err
+	}
+	return n, nil
+}
+
+// RemoveStaleTemp deletes in-progress files older than maxAge, left behind
+// by uploads the process did not live to finish.
+func (s *localStorage) RemoveStaleTemp(maxAge time.Duration) int {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return 0
+	}
+	removed := 0
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), tempSuffix) {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil || time.Since(info.ModTime()) < maxAge {
+			continue
+		}
+		if os.Remove(filepath.Join(s.dir, e.Name())) == nil {
+			removed++
+		}
+	}
+	return removed
+}
+
+func (s *localStorage) String() string { return "local:" + s.dir }
+
+func (s *localStorage) Get(id string) (io.ReadCloser, error) {
+	p, err := s.path(id)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(p)
+}
+
+func (s *localStorage) Delete(id string) error {
+	p, err := s.path(id)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(p)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (s *localStorage) Stat(id string) (int64, error) {
+	p, err := s.path(id)
+	if err != nil {
+		return 0, err
+	}
+	info, err := os.Stat(p)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// ============================================
+// S3-Compatible Object Storage
+// ============================================
+
+// s3Storage is a minimal path-style S3 client (AWS, MinIO, R2, ...) signed
+// with SigV4. Objects are keyed as {prefix}{id}. Expiry is still driven by
+// the uploading instance's cleanup loop, so pair it with a bucket lifecycle
+// rule to catch objects orphaned by a crashed node.
+type s3Storage struct {
+	endpoint  *url.URL
+	bucket    string
+	region    string
+	prefix    string
+	accessKey string
+	secretKey string
+	client    *http.Client
+	bufs      *bufferPool
+}
+
+func newS3Storage(cfg *Config, bufs *bufferPool) (*s3Storage, error) {
+	if cfg.S3Endpoint == "" || cfg.S3Bucket == "" {
+		return nil, fmt.Errorf("s3 storage requires SENDIT_GO_S3_ENDPOINT and SENDIT_GO_S3_BUCKET")
+	}
+	u, err := url.Parse(cfg.S3Endpoint)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid S3 endpoint %q", cfg.S3Endpoint)
+	}
+	return &s3Storage{
+		endpoint:  u,
+		bucket:    cfg.S3Bucket,
+		region:    cfg.S3Region,
+		prefix:    cfg.S3Prefix,
+		accessKey: cfg.S3AccessKey,
+		secretKey: cfg.S3SecretKey,
+		client:    &http.Client{},
+		bufs:      bufs,
+	}, nil
+}
+
+func (s *s3Storage) objectURL(id string) *url.URL {
+	u := *s.endpoint
+	// Path is escaped once by EscapedPath/String; a "/" in the prefix
+	// stays a separator so prefix-scoped bucket rules still match.
+	u.Path = "/" + s.bucket + "/" + s.prefix + id
+	u.RawPath = ""
+	return &u
+}
+
+func (s *s3Storage) do(method, id string, body io.Reader, size int64) (*http.Response, error) {
+	req, err := http.NewRequest(method, s.objectURL(id).String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	s.sign(req)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, os.ErrNotExist
+	}
+	if resp.StatusCode >= 300 {
+		resp.Body.Close()
+		return nil, fmt.Errorf("s3 %s %s: %s", method, id, resp.Status)
+	}
+	return resp, nil
+}
+
+func (s *s3Storage) Put(id string, r io.Reader) (int64, error) {
+	// S3 needs a Content-Length up front, so spool the (possibly
+	// compressed) stream to a temp file first.
+	tmp, err := os.CreateTemp("", "sendit-s3-*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	buf := s.bufs.get()
+	defer s.bufs.put(buf)
+
+	n, err := io.CopyBuffer(tmp, r, *buf)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	resp, err := s.do(http.MethodPut, id, tmp, n)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return n, nil
+}
+
+func (s *s3Storage) String() string { return "s3:" + s.bucket + "/" + s.prefix }
+
+func (s *s3Storage) Get(id string) (io.ReadCloser, error) {
+	resp, err := s.do(http.MethodGet, id, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (s *s3Storage) Delete(id string) error {
+	resp, err := s.do(http.MethodDelete, id, nil, 0)
+	if err == os.ErrNotExist {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *s3Storage) Stat(id string) (int64, error) {
+	resp, err := s.do(http.MethodHead, id, nil, 0)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return resp.ContentLength, nil
+}
+
+// sign adds AWS Signature Version 4 headers. The payload is sent as
+// UNSIGNED-PAYLOAD so bodies can stream without hashing them twice.
+func (s *s3Storage) sign(req *http.Request) {
+	now := time.Now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	const payloadHash = "UNSIGNED-PAYLOAD"
+
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalHeaders := "host:" + req.URL.Host + "\n" +
+		"x-amz-content-sha256:" + payloadHash + "\n" +
+		"x-amz-date:" + amzDate + "\n"
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	crHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(crHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), date)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// ============================================
+// Mirrored Storage
+// ============================================
+
+// mirrorStorage keeps a second copy of everything in secondary. Sync puts
+// tee the upload into both backends at once; async puts copy from primary
+// afterwards. With required set, a failed sync mirror fails the Put;
+// otherwise it is logged and the primary copy stands. Reads fall back to
+// secondary when primary can't serve them.
+type mirrorStorage struct {
+	primary   Storage
+	secondary Storage
+	async     bool
+	required  bool
+}
+
+func (m *mirrorStorage) Put(id string, r io.Reader) (int64, error) {
+	if m.async {
+		n, err := m.primary.Put(id, r)
+		if err == nil {
+			go m.copy(id)
+		}
+		return n, err
+	}
+
+	pr, pw := io.Pipe()
+	mirrored := make(chan error, 1)
+	go func() {
+		_, err := m.secondary.Put(id, pr)
+		pr.CloseWithError(err) // a secondary that gave up must not stall the tee
+		mirrored <- err
+	}()
+
+	tee := &mirrorTee{w: pw}
+	n, err := m.primary.Put(id, io.TeeReader(r, tee))
+	pw.CloseWithError(err)
+	merr := <-mirrored
+	if merr == nil {
+		merr = tee.err
+	}
+
+	if err != nil {
+		m.secondary.Delete(id)
+		return n, err
+	}
+	if merr != nil {
+		m.secondary.Delete(id)
+		if m.required {
+			m.primary.Delete(id)
+			return 0, fmt.Errorf("mirror %s: %w", id, merr)
+		}
+		log.Printf("[Mirror] %s not mirrored: %v", id, merr)
+	}
+	return n, nil
+}
+
+// copy mirrors an already stored object, for async mode.
+func (m *mirrorStorage) copy(id string) {
+	rc, err := m.primary.Get(id)
+	if err == nil {
+		_, err = m.secondary.Put(id, rc)
+		rc.Close()
+	}
+	if err != nil {
+		log.Printf("[Mirror] %s not mirrored: %v", id, err)
+	}
+}
+
+func (m *mirrorStorage) Get(id string) (io.ReadCloser, error) {
+	rc, err := m.primary.Get(id)
+	if err != nil {
+		if rc2, err2 := m.secondary.Get(id); err2 == nil {
+			return rc2, nil
+		}
+	}
+	return rc, err
+}
+
+func (m *mirrorStorage) Delete(id string) error {
+	m.secondary.Delete(id)
+	return m.primary.Delete(id)
+}
+
+func (m *mirrorStorage) Stat(id string) (int64, error) {
+	n, err := m.primary.Stat(id)
+	if err != nil {
+		if n2, err2 := m.secondary.Stat(id); err2 == nil {
+			return n2, nil
+		}
+	}
+	return n, err
+}
+
+func (m *mirrorStorage) RemoveStaleTemp(maxAge time.Duration) int {
+	n := 0
+	for _, s := range []Storage{m.primary, m.secondary} {
+		if r, ok := s.(staleTempRemover); ok {
+			n += r.RemoveStaleTemp(maxAge)
+		}
+	}
+	return n
+}
+
+// Locations names both backends, as recorded in FileMeta.
+func (m *mirrorStorage) Locations() []string {
+	return []string{fmt.Sprint(m.primary), fmt.Sprint(m.secondary)}
+}
+
+// mirrorTee feeds the secondary's pipe but never fails the primary's read:
+// once the mirror errors, the rest of the upload is not copied to it.
+type mirrorTee struct {
+	w   io.Writer
+	err error
+}
+
+func (t *mirrorTee) Write(p []byte) (int, error) {
+	if t.err == nil {
+		_, t.err = t.w.Write(p)
+	}
+	return len(p), nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLocalStoragePathConfined(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "uploads")
+	s, err := newLocalStorage(dir, newBufferPool(1024), retryPolicy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	outside := filepath.Join(filepath.Dir(dir), "outside")
+	if err := os.WriteFile(outside, []byte("x"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range []string{"", ".", "..", "../outside", `..\outside`, "a/b", "/etc/passwd"} {
+		if _, err := s.path(id); err != errInvalidStorageID {
+			t.Errorf("path(%q) = %v, want errInvalidStorageID", id, err)
+		}
+		if _, err := s.Get(id); err == nil {
+			t.Errorf("Get(%q) succeeded", id)
+		}
+		if _, err := s.Put(id, strings.NewReader("x")); err == nil {
+			t.Errorf("Put(%q) succeeded", id)
+		}
+		if err := s.Delete(id); err == nil {
+			t.Errorf("Delete(%q) succeeded", id)
+		}
+	}
+	if _, err := os.Stat(outside); err != nil {
+		t.Errorf("file outside the upload dir was touched: %v", err)
+	}
+
+	p, err := s.path("0123456789abcdef01234567")
+	if err != nil || filepath.Dir(p) != dir {
+		t.Errorf("path(valid) = %q, %v; want a file in %s", p, err, dir)
+	}
+}
+
+// A prefix containing "/" must reach S3 as path separators, not as an
+// escaped key, so objects land under the prefix.
+func TestS3StorageKeepsPrefixPath(t *testing.T) {
+	var paths []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.Method+" "+r.URL.EscapedPath())
+		if !strings.Contains(r.Header.Get("Authorization"), "Signature=") {
+			t.Errorf("%s %s not signed", r.Method, r.URL.Path)
+		}
+		io.Copy(io.Discard, r.Body)
+	}))
+	defer srv.Close()
+
+	s, err := newS3Storage(&Config{
+		S3Endpoint: srv.URL,
+		S3Bucket:   "bucket",
+		S3Region:   "us-east-1",
+		S3Prefix:   "sendit/uploads/",
+	}, newBufferPool(1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+	const id = "0123456789abcdef01234567"
+	if _, err := s.Put(id, strings.NewReader("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete(id); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"PUT /bucket/sendit/uploads/" + id,
+		"DELETE /bucket/sendit/uploads/" + id,
+	}
+	if strings.Join(paths, "\n") != strings.Join(want, "\n") {
+		t.Errorf("requests = %q, want %q", paths, want)
+	}
+	if got := s.objectURL(id).EscapedPath(); got != "/bucket/sendit/uploads/"+id {
+		t.Errorf("signed path = %q", got)
+	}
+}